@@ -0,0 +1,229 @@
+package main
+
+import (
+	"deploy-bot/approval"
+	"deploy-bot/audit"
+	"deploy-bot/auth"
+	"deploy-bot/config"
+	"deploy-bot/logging"
+	"deploy-bot/pipeline"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"deploy-bot/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Block Kit IDs the interaction handler dispatches on
+const (
+	approveAction  = "approve"
+	rejectAction   = "reject"
+	rejectCallback = "reject"
+	reasonBlock    = "reason"
+)
+
+// Section text is capped at 3000 characters by Slack
+const maxDiffLength = 2500
+
+// approveDeploy returns the pipeline's approval gate for record when its environment
+// needs a second person to approve, or nil when it doesn't
+func (b *Bot) approveDeploy(record *store.Deploy, connInfo slackbot.ConnInfo) func(s *pipeline.State) error {
+	cfg := config.Get().Approval
+	if !cfg.RequiredFor(record.Environment) {
+		return nil
+	}
+	return func(s *pipeline.State) error {
+		r := &approval.Request{
+			ID:        strconv.Itoa(record.ID),
+			App:       record.App,
+			Env:       record.Environment,
+			Requester: record.Requester,
+			Expires:   time.Now().Add(cfg.ExpiryDuration()),
+		}
+		b.Approvals.Open(r)
+
+		diff := util.DiffLines(s.OldValues, string(s.NewValues))
+		if len(diff) > maxDiffLength {
+			diff = diff[:maxDiffLength] + "\n..."
+		}
+		summary := fmt.Sprintf("*Approval needed* for deploy #%d: `%s` %s → `%s` in %s, requested by <@%s>",
+			record.ID, s.App, s.Ref, s.ImageTag, s.Env, record.Requester)
+		expiry := fmt.Sprintf("Expires at %s. Approvers other than the requester can approve", r.Expires.Format("15:04 MST"))
+		blocks := []slack.Block{
+			slack.NewSectionBlock(slack.NewTextBlockObject("mrkdwn", summary, false, false), nil, nil),
+			slack.NewSectionBlock(slack.NewTextBlockObject("mrkdwn", "```"+diff+"```", false, false), nil, nil),
+			slack.NewContextBlock("", slack.NewTextBlockObject("mrkdwn", expiry, false, false)),
+			slack.NewActionBlock("",
+				slack.NewButtonBlockElement(approveAction, r.ID, slack.NewTextBlockObject("plain_text", "Approve", false, false)).WithStyle(slack.StylePrimary),
+				slack.NewButtonBlockElement(rejectAction, r.ID, slack.NewTextBlockObject("plain_text", "Reject", false, false)).WithStyle(slack.StyleDanger),
+			),
+		}
+		ts, err := b.Slack.PostBlocks(connInfo, summary, blocks...)
+		if err != nil {
+			b.Approvals.Decide(r.ID, approval.Decision{By: "deploy-bot", Reason: "approval request could not be posted"})
+			return &pipeline.StageError{Msg: fmt.Sprintf("_Error posting approval request: %s_", err), Err: err}
+		}
+
+		d, err := b.Approvals.Wait(s.Ctx, r)
+		outcome := d.String()
+		switch {
+		case errors.Is(err, approval.ErrExpired):
+			outcome = "expired"
+		case err != nil:
+			outcome = "cancelled"
+		}
+		actor := d.By
+		if actor == "" {
+			actor = "deploy-bot"
+		}
+		b.auditEvent(audit.Entry{
+			Actor:   actor,
+			Action:  "approval",
+			Channel: connInfo.Channel,
+			App:     record.App,
+			Env:     record.Environment,
+			Outcome: outcome,
+			Detail:  fmt.Sprintf("deploy #%d of %s requested by %s", record.ID, s.ImageTag, record.Requester),
+		})
+		// Swap the buttons for the outcome so nobody clicks a stale request
+		blocks = append(blocks[:3], slack.NewContextBlock("", slack.NewTextBlockObject("mrkdwn", "*"+outcome+"*", false, false)))
+		if err := b.Slack.UpdateBlocks(connInfo, ts, summary, blocks...); err != nil {
+			logging.FromContext(s.Ctx).Errorf("Error updating approval request for deploy #%d: %s", record.ID, err)
+		}
+
+		if errors.Is(err, approval.ErrExpired) {
+			return &pipeline.StageError{Msg: fmt.Sprintf("_Approval for deploy #%d expired_", record.ID), Err: err}
+		}
+		if err != nil {
+			return err
+		}
+		if !d.Approved {
+			return &pipeline.StageError{Msg: fmt.Sprintf("_Deploy #%d %s_", record.ID, d)}
+		}
+		b.Slack.SendMessage(connInfo, fmt.Sprintf("_Deploy #%d %s_", record.ID, d))
+		return nil
+	}
+}
+
+// slackInteraction handles the Approve and Reject buttons, and the reject reason modal
+func (b *Bot) slackInteraction(w http.ResponseWriter, r *http.Request) {
+	body, ok := readSlackRequest(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var cb slack.InteractionCallback
+	if err := json.Unmarshal([]byte(form.Get("payload")), &cb); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if resp := b.handleInteraction(&cb); resp != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// handleInteraction dispatches an interaction from either transport, returning
+// the payload to respond with, if any
+func (b *Bot) handleInteraction(cb *slack.InteractionCallback) map[string]interface{} {
+	switch cb.Type {
+	case slack.InteractionTypeBlockActions:
+		for _, action := range cb.ActionCallback.BlockActions {
+			switch action.ActionID {
+			case approveAction:
+				go b.doApprove(action.Value, cb)
+			case rejectAction:
+				openRejectModal(action.Value, cb)
+			}
+		}
+	case slack.InteractionTypeViewSubmission:
+		if cb.View.CallbackID != rejectCallback {
+			return nil
+		}
+		reason := cb.View.State.Values[reasonBlock][reasonBlock].Value
+		if err := b.doReject(cb.View.PrivateMetadata, cb.User.ID, reason); err != nil {
+			// Keeps the modal open with the error under the reason field
+			return map[string]interface{}{
+				"response_action": "errors",
+				"errors":          map[string]string{reasonBlock: err.Error()},
+			}
+		}
+	}
+	return nil
+}
+
+// The thread an interaction happened in
+func interactionThread(cb *slack.InteractionCallback) slackbot.ConnInfo {
+	ts := cb.Message.ThreadTimestamp
+	if ts == "" {
+		ts = cb.Message.Timestamp
+	}
+	return slackbot.ConnInfo{
+		Client:    slackbot.Client(),
+		Channel:   cb.Channel.ID,
+		Timestamp: ts,
+	}
+}
+
+func (b *Bot) doApprove(id string, cb *slack.InteractionCallback) {
+	connInfo := interactionThread(cb)
+	user := cb.User.ID
+	req := b.Approvals.Get(id)
+	if req == nil {
+		b.Slack.SendMessage(connInfo, fmt.Sprintf("_<@%s> deploy #%s is no longer waiting on approval_", user, id))
+		return
+	}
+	if !b.can(user, req.App, req.Env, auth.Approver) {
+		msg := fmt.Sprintf("_<@%s> あなたはふさわしくない, translation: you need the approver role for `%s` in %s_", user, req.App, req.Env)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if _, err := b.Approvals.Decide(id, approval.Decision{Approved: true, By: user}); err != nil {
+		b.Slack.SendMessage(connInfo, fmt.Sprintf("_<@%s> %s_", user, err))
+	}
+}
+
+func openRejectModal(id string, cb *slack.InteractionCallback) {
+	view := slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		CallbackID:      rejectCallback,
+		PrivateMetadata: id,
+		Title:           slack.NewTextBlockObject("plain_text", fmt.Sprintf("Reject deploy #%s", id), false, false),
+		Submit:          slack.NewTextBlockObject("plain_text", "Reject", false, false),
+		Close:           slack.NewTextBlockObject("plain_text", "Cancel", false, false),
+		Blocks: slack.Blocks{BlockSet: []slack.Block{
+			slack.NewInputBlock(
+				reasonBlock,
+				slack.NewTextBlockObject("plain_text", "Reason", false, false),
+				slack.NewPlainTextInputBlockElement(slack.NewTextBlockObject("plain_text", "Why shouldn't this go out?", false, false), reasonBlock),
+			),
+		}},
+	}
+	if _, err := slackbot.Client().OpenView(cb.TriggerID, view); err != nil {
+		logging.Errorf("Error opening reject modal for deploy #%s: %s", id, err)
+	}
+}
+
+// doReject rejects a deploy on behalf of an approver, or the requester withdrawing it
+func (b *Bot) doReject(id, user, reason string) error {
+	req := b.Approvals.Get(id)
+	if req == nil {
+		return approval.ErrNotFound
+	}
+	if user != req.Requester && !b.can(user, req.App, req.Env, auth.Approver) {
+		return fmt.Errorf("you need the approver role for %s in %s", req.App, req.Env)
+	}
+	_, err := b.Approvals.Decide(id, approval.Decision{By: user, Reason: reason})
+	return err
+}
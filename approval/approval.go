@@ -0,0 +1,112 @@
+package approval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound     = errors.New("approval request not found or already decided")
+	ErrSelfApproval = errors.New("you can't approve your own deploy")
+	ErrExpired      = errors.New("approval request expired")
+)
+
+type Decision struct {
+	Approved bool
+	By       string // Slack user ID
+	Reason   string
+}
+
+// Request is an approval a deploy is waiting on
+type Request struct {
+	ID        string
+	App       string
+	Env       string
+	Requester string
+	Expires   time.Time
+
+	decision chan Decision
+}
+
+type Manager struct {
+	mu      sync.Mutex
+	pending map[string]*Request
+}
+
+func NewManager() *Manager {
+	return &Manager{pending: make(map[string]*Request)}
+}
+
+// Open registers r so that Decide can resolve it
+func (m *Manager) Open(r *Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.decision = make(chan Decision, 1)
+	m.pending[r.ID] = r
+}
+
+// Get returns the pending request with the given ID, or nil
+func (m *Manager) Get(id string) *Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pending[id]
+}
+
+// Decide resolves a pending request. Nobody can approve their own deploy,
+// but the requester can reject it to withdraw it
+func (m *Manager) Decide(id string, d Decision) (*Request, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.pending[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if time.Now().After(r.Expires) {
+		return r, ErrExpired
+	}
+	if d.Approved && d.By == r.Requester {
+		return r, ErrSelfApproval
+	}
+	delete(m.pending, id)
+	r.decision <- d
+	return r, nil
+}
+
+// Wait blocks until r is decided, expires or ctx is done
+func (m *Manager) Wait(ctx context.Context, r *Request) (Decision, error) {
+	timer := time.NewTimer(time.Until(r.Expires))
+	defer timer.Stop()
+	select {
+	case d := <-r.decision:
+		return d, nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.pending, r.ID)
+		return Decision{}, ctx.Err()
+	case <-timer.C:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// A decision may have landed as the timer fired
+		select {
+		case d := <-r.decision:
+			return d, nil
+		default:
+		}
+		delete(m.pending, r.ID)
+		return Decision{}, ErrExpired
+	}
+}
+
+func (d Decision) String() string {
+	if d.Approved {
+		return fmt.Sprintf("approved by <@%s>", d.By)
+	}
+	if d.Reason == "" {
+		return fmt.Sprintf("rejected by <@%s>", d.By)
+	}
+	return fmt.Sprintf("rejected by <@%s>: %s", d.By, d.Reason)
+}
@@ -0,0 +1,61 @@
+package approval_test
+
+import (
+	"context"
+	"deploy-bot/approval"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecide(t *testing.T) {
+	m := approval.NewManager()
+	r := &approval.Request{ID: "1", Requester: "U1", Expires: time.Now().Add(time.Minute)}
+	m.Open(r)
+
+	if _, err := m.Decide("1", approval.Decision{Approved: true, By: "U1"}); !errors.Is(err, approval.ErrSelfApproval) {
+		t.Errorf("Self approval got error %v, want %v", err, approval.ErrSelfApproval)
+	}
+	if _, err := m.Decide("2", approval.Decision{Approved: true, By: "U2"}); !errors.Is(err, approval.ErrNotFound) {
+		t.Errorf("Unknown request got error %v, want %v", err, approval.ErrNotFound)
+	}
+	if _, err := m.Decide("1", approval.Decision{Approved: true, By: "U2"}); err != nil {
+		t.Errorf("Approval got error %v", err)
+	}
+	if _, err := m.Decide("1", approval.Decision{By: "U3"}); !errors.Is(err, approval.ErrNotFound) {
+		t.Errorf("Second decision got error %v, want %v", err, approval.ErrNotFound)
+	}
+
+	d, err := m.Wait(context.Background(), r)
+	if err != nil || !d.Approved || d.By != "U2" {
+		t.Errorf("Wait() got %+v, %v, want approval by U2", d, err)
+	}
+}
+
+func TestWaitExpires(t *testing.T) {
+	m := approval.NewManager()
+	r := &approval.Request{ID: "1", Requester: "U1", Expires: time.Now().Add(10 * time.Millisecond)}
+	m.Open(r)
+
+	if _, err := m.Wait(context.Background(), r); !errors.Is(err, approval.ErrExpired) {
+		t.Errorf("Wait() got error %v, want %v", err, approval.ErrExpired)
+	}
+	if m.Get("1") != nil {
+		t.Errorf("Expired request is still pending")
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	m := approval.NewManager()
+	r := &approval.Request{ID: "1", Requester: "U1", Expires: time.Now().Add(time.Minute)}
+	m.Open(r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.Wait(ctx, r); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() got error %v, want %v", err, context.Canceled)
+	}
+	if m.Get("1") != nil {
+		t.Errorf("Cancelled request is still pending")
+	}
+}
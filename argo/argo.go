@@ -1,48 +1,94 @@
 package argo
 
 import (
+	"context"
 	"crypto/tls"
-	slackbot "deploy-bot/slack"
+	"crypto/x509"
+	"deploy-bot/config"
+	"deploy-bot/logging"
+	"deploy-bot/metrics"
+	"deploy-bot/tracing"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
+	"sort"
 	"time"
 )
 
-func Client() *http.Client {
-	t := &http.Transport{
-		//TLSHandshakeTimeout: 0,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			//SessionTicketsDisabled: true,
-			//VerifyConnection:       tls.ConnectionState{HandshakeComplete: true},
-			//Time: time.Time{},
-		},
-		//DisableKeepAlives: false,
-		//		MaxIdleConns:        0,
-		//		MaxConnsPerHost:     0,
-		//		MaxIdleConnsPerHost: 0,
-		//		IdleConnTimeout:     0,
-		//		ForceAttemptHTTP2:   true,
+// Client authenticates every request with the token for the app's Argo project, see tokens
+func Client(cfg config.Argo) (*http.Client, error) {
+	tlsConfig, err := TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	t := tracing.Transport("argo", &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	})
+	tokens, err := newTokens(&http.Client{Transport: t, Timeout: time.Second * 15}, cfg)
+	if err != nil {
+		return nil, err
 	}
 	client := &http.Client{
-		Transport: t,
+		Transport: &authTransport{base: t, tokens: tokens},
 		Timeout:   time.Second * 15,
 	}
-	return client
+	return client, nil
 }
 
-func buildRequest(path, method string, payload io.Reader) *http.Request {
+// TLSConfig verifies Argo's certificate against the system roots plus any in the PEM
+// bundle at ARGOCD_CA_FILE, and presents ARGOCD_CLIENT_CERT and ARGOCD_CLIENT_KEY when
+// Argo requires mTLS. Verification is only skipped when ARGOCD_INSECURE is true
+func TLSConfig() (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := os.Getenv("ARGOCD_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ARGOCD_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ARGOCD_CA_FILE %s", caFile)
+		}
+		c.RootCAs = pool
+	}
+
+	certFile, keyFile := os.Getenv("ARGOCD_CLIENT_CERT"), os.Getenv("ARGOCD_CLIENT_KEY")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("ARGOCD_CLIENT_CERT and ARGOCD_CLIENT_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading Argo client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if os.Getenv("ARGOCD_INSECURE") == "true" {
+		logging.Warnf("ARGOCD_INSECURE is set: NOT verifying the certificate of %s, so ARGOCD_JWT goes to whoever answers there. Never run like this in production", os.Getenv("ARGOCD_SERVER"))
+		c.InsecureSkipVerify = true
+	}
+	return c, nil
+}
+
+// AppURL links to the app in the Argo CD UI
+func AppURL(app string) string {
+	return fmt.Sprintf("%s/applications/%s", os.Getenv("ARGOCD_SERVER"), app)
+}
+
+func buildRequest(ctx context.Context, path, method string, payload io.Reader) *http.Request {
 	url := fmt.Sprintf("%s/%s", os.Getenv("ARGOCD_SERVER"), path)
-	req, err := http.NewRequest(method, url, payload)
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
 	if err != nil {
-		log.Printf("Error building argo request: %s", err.Error())
+		logging.FromContext(ctx).Errorf("Error building argo request: %s", err.Error())
 	}
-	var bearer = "Bearer " + os.Getenv("ARGOCD_JWT")
-	req.Header.Add("Authorization", bearer)
 	return req
 }
 
@@ -62,47 +108,147 @@ func buildRequest(path, method string, payload io.Reader) *http.Request {
 //	return nil
 //}
 
-func ForwardGitshot(client *http.Client, payload io.Reader) (string, error) {
+func ForwardGitshot(ctx context.Context, client *http.Client, payload io.Reader) (string, error) {
 	// TODO: A more sophisticated way to do this is to forward the request
 	// with headers intact instead of reconstructing as a new request
 	path := "api/webhook"
-	req := buildRequest(path, "POST", payload)
+	req := buildRequest(ctx, path, "POST", payload)
 	req.Header.Add("X-Github-Event", "push")
-	if _, err := client.Do(req); err != nil {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("_Error forwarding gitshot to Argocd: `%v`_", err), err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
 		return fmt.Sprintf("_Error forwarding gitshot to Argocd: `%v`_", err), err
 	}
 	return fmt.Sprintf("_Argocd received Github webhook_"), nil
 }
 
-func SyncApplication(client *http.Client, app string) (string, error) {
+func SyncApplication(ctx context.Context, client *http.Client, app string) (string, error) {
 	path := fmt.Sprintf("api/v1/applications/%s/sync", app)
-	req := buildRequest(path, "POST", nil)
-	if _, err := client.Do(req); err != nil {
+	req := buildRequest(ctx, path, "POST", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("_Error syncing %s in Argocd: `%v`_", app, err), err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
 		return fmt.Sprintf("_Error syncing %s in Argocd: `%v`_", app, err), err
 	}
 	return fmt.Sprintf("_`%s` sync underway_", app), nil
 }
 
-func DoStatusLoop(argoc *http.Client, app string, connInfo slackbot.ConnInfo) {
-	time.Sleep(time.Second * 5) // Argo typically starts processing webhooks in <1s upon receipt
+// DiffApplication reports the app's current drift: "Kind/name" for every managed resource
+// whose live state differs from the gitops revision Argo already has. It can't show what a
+// new values file would change, Argo only renders revisions that have been pushed
+func DiffApplication(ctx context.Context, client *http.Client, app string) ([]string, string, error) {
+	path := fmt.Sprintf("api/v1/applications/%s/managed-resources", app)
+	req := buildRequest(ctx, path, "GET", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Sprintf("_Error diffing %s in Argocd: `%v`_", app, err), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
+		return nil, fmt.Sprintf("_Error diffing %s in Argocd: `%v`_", app, err), err
+	}
+
+	var managed struct {
+		Items []struct {
+			Kind     string `json:"kind"`
+			Name     string `json:"name"`
+			Modified bool   `json:"modified"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&managed); err != nil {
+		return nil, fmt.Sprintf("_Error parsing Argocd diff for %s: `%v`_", app, err), err
+	}
+
+	var modified []string
+	for _, r := range managed.Items {
+		if r.Modified {
+			modified = append(modified, fmt.Sprintf("%s/%s", r.Kind, r.Name))
+		}
+	}
+	return modified, "", nil
+}
+
+// CheckSession confirms Argo is reachable and accepts the bot's token
+func CheckSession(ctx context.Context, client *http.Client) error {
+	req := buildRequest(ctx, "api/v1/session/userinfo", "GET", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var info struct {
+		LoggedIn bool `json:"loggedIn"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+	if !info.LoggedIn {
+		return errors.New("token was not accepted")
+	}
+	return nil
+}
+
+// How DoStatusLoop polls Argo, shortened by tests
+var (
+	StatusDelay    = 5 * time.Second // Argo typically starts processing webhooks in <1s upon receipt
+	StatusInterval = 4 * time.Second
+	StatusPolls    = 6
+)
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// DoStatusLoop reports deployment statuses to Slack until the app Syncs, we give up
+// or ctx is done, returning the final result
+func DoStatusLoop(ctx context.Context, argoc *http.Client, app string, notify func(msg string)) string {
+	if err := sleep(ctx, StatusDelay); err != nil {
+		return err.Error()
+	}
 	loopCount := 0
 	outOfSyncCount := 0
 	unknownCount := 0
 	syncCount := 0
 	for {
-		fmt.Printf("loopCount == %d\n", loopCount)
-		if loopCount >= 6 {
-			path := fmt.Sprintf("applications/%s", app)
-			url := fmt.Sprintf("%s/%s", os.Getenv("ARGOCD_SERVER"), path)
-			msg := fmt.Sprintf("_ Potential `Sync` error, please investigate: %s _", url)
-			slackbot.SendMessage(connInfo, msg)
-			return
+		if loopCount >= StatusPolls {
+			msg := fmt.Sprintf("_ Potential `Sync` error, please investigate: %s _", AppURL(app))
+			notify(msg)
+			return "Sync timeout"
 		}
 
-		status, msg, err := getDeploymentStatus(argoc, app)
+		status, msg, err := getDeploymentStatus(ctx, argoc, app)
+		if ctx.Err() != nil {
+			return ctx.Err().Error()
+		}
+		metrics.APIError("argo", "status", err)
+		logging.FromContext(ctx).Debugf("Deployment statuses of %s: %v", app, status)
 		if err != nil {
-			log.Printf("_Error getting deployment status: %s _", err)
-			slackbot.SendMessage(connInfo, msg)
+			logging.FromContext(ctx).Warnf("Error getting deployment status: %s", err)
+			notify(msg)
 		}
 		if status != nil {
 			for d, s := range status {
@@ -113,17 +259,18 @@ func DoStatusLoop(argoc *http.Client, app string, connInfo slackbot.ConnInfo) {
 					unknownCount++
 				case "Synced":
 					syncCount++
+				case "Degraded":
+					msg := fmt.Sprintf("_%s is `Degraded`, please investigate: %s _", d, AppURL(app))
+					notify(msg)
+					return "Degraded"
 				}
 				msg := fmt.Sprintf("_%s: `%s`_", d, s)
 				if (s == "OutOfSync") && (outOfSyncCount < 2) { // works with <=
-					//					fmt.Printf("outOfSyncCount == %d\n", outOfSyncCount)
-					slackbot.SendMessage(connInfo, msg)
+					notify(msg)
 				} else if (s == "Unknown") && (unknownCount < 2) {
-					//					fmt.Printf("unknownCount == %d\n", syncCount)
-					slackbot.SendMessage(connInfo, msg)
-					//					fmt.Printf("syncCount == %d\n", syncCount)
+					notify(msg)
 					//					msg := fmt.Sprintf("_%s: `%s`_", app, s)
-					//					slackbot.SendMessage(connInfo, msg)
+					//					notify(msg)
 					//					break
 				} else {
 					break
@@ -132,38 +279,118 @@ func DoStatusLoop(argoc *http.Client, app string, connInfo slackbot.ConnInfo) {
 		}
 
 		loopCount++
-		time.Sleep(time.Second * 4)
+		if err := sleep(ctx, StatusInterval); err != nil {
+			return err.Error()
+		}
 		if syncCount == 2 { // The app and sidekiq deployments have Synced, representing a good proxy for complete application Sync
 			msg := fmt.Sprintf("`_%s` Synced_", app)
-			slackbot.SendMessage(connInfo, msg)
-			break
+			notify(msg)
+			return "Synced"
 		}
 	}
 }
 
-func getDeploymentStatus(client *http.Client, app string) (map[string]string, string, error) {
+func getDeploymentStatus(ctx context.Context, client *http.Client, app string) (map[string]string, string, error) {
 	path := fmt.Sprintf("api/v1/applications/%s", app)
-	req := buildRequest(path, "GET", nil)
+	req := buildRequest(ctx, path, "GET", nil)
 	resp, err := client.Do(req)
 	if err != nil {
 		msg := fmt.Sprintf("_Error getting deployment status: `%s`_", err)
 		return nil, msg, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
+		msg := fmt.Sprintf("_Error getting deployment status: `%s`_", err)
+		return nil, msg, err
+	}
 
-	body, _ := io.ReadAll(resp.Body)
-	// TODO: Figure out most idiomatic way to parse this json
-	application := make(map[string]interface{})
-	json.Unmarshal(body, &application)
-	status := application["status"]
-	resources := status.(map[string]interface{})["resources"]
+	var application struct {
+		Status struct {
+			Resources []struct {
+				Kind   string `json:"kind"`
+				Name   string `json:"name"`
+				Status string `json:"status"`
+				Health struct {
+					Status string `json:"status"`
+				} `json:"health"`
+			} `json:"resources"`
+		} `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&application); err != nil {
+		msg := fmt.Sprintf("_Error parsing deployment status: `%s`_", err)
+		return nil, msg, err
+	}
+
+	// Each deployment's sync status, unless it is unhealthy or still rolling out
 	deploymentStatus := make(map[string]string)
-	for _, r := range resources.([]interface{}) {
-		if r.(map[string]interface{})["kind"] == "Deployment" {
-			name := r.(map[string]interface{})["name"].(string)
-			status := r.(map[string]interface{})["status"].(string)
-			deploymentStatus[name] = status
+	for _, r := range application.Status.Resources {
+		if r.Kind != "Deployment" {
+			continue
+		}
+		deploymentStatus[r.Name] = r.Status
+		if r.Health.Status == "Degraded" || r.Health.Status == "Progressing" {
+			deploymentStatus[r.Name] = r.Health.Status
 		}
 	}
 	return deploymentStatus, "", nil
 }
+
+// Controller is the live pipeline.CDController
+type Controller struct {
+	Client *http.Client
+	// Projects with their own token, which Check confirms along with the default one
+	projects []string
+}
+
+func New(cfg config.Argo) (*Controller, error) {
+	client, err := Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &Controller{Client: client}
+	for name := range cfg.Projects {
+		c.projects = append(c.projects, name)
+	}
+	sort.Strings(c.projects)
+	return c, nil
+}
+
+func (c *Controller) ForwardGitshot(ctx context.Context, payload io.Reader) (string, error) {
+	msg, err := ForwardGitshot(ctx, c.Client, payload)
+	metrics.APIError("argo", "webhook", err)
+	return msg, err
+}
+
+func (c *Controller) Sync(ctx context.Context, app string) (string, error) {
+	msg, err := SyncApplication(ctx, c.Client, app)
+	metrics.APIError("argo", "sync", err)
+	return msg, err
+}
+
+func (c *Controller) Diff(ctx context.Context, app string) ([]string, string, error) {
+	modified, msg, err := DiffApplication(ctx, c.Client, app)
+	metrics.APIError("argo", "diff", err)
+	return modified, msg, err
+}
+
+// Check is the readiness check for Argo, confirming the default token and every project's
+func (c *Controller) Check(ctx context.Context) error {
+	err := CheckSession(ctx, c.Client)
+	metrics.APIError("argo", "userinfo", err)
+	if err != nil {
+		return err
+	}
+	for _, project := range c.projects {
+		err := CheckSession(withProject(ctx, project), c.Client)
+		metrics.APIError("argo", "userinfo", err)
+		if err != nil {
+			return fmt.Errorf("project %s: %w", project, err)
+		}
+	}
+	return nil
+}
+
+func (c *Controller) WatchSync(ctx context.Context, app string, notify func(msg string)) string {
+	return DoStatusLoop(ctx, c.Client, app, notify)
+}
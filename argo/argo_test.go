@@ -0,0 +1,317 @@
+package argo_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"deploy-bot/argo"
+	"deploy-bot/config"
+	"deploy-bot/internal/fakeargo"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newController(t *testing.T) *argo.Controller {
+	t.Helper()
+	c, err := argo.New(config.Argo{})
+	if err != nil {
+		t.Fatalf("argo.New(config.Argo{}) got error %v", err)
+	}
+	return c
+}
+
+func TestDoStatusLoop(t *testing.T) {
+	argo.StatusDelay, argo.StatusInterval, argo.StatusPolls = 0, 0, 4
+	deployments := []string{"time", "time-sidekiq"}
+
+	tt := []struct {
+		desc    string
+		script  []fakeargo.State
+		sync    bool
+		failing int  // Status code for every status request
+		cancel  bool // Cancel the watch once the sync is requested
+		want    string
+		wantMsg string // Somewhere in the messages sent
+	}{
+		{"Synced", []fakeargo.State{fakeargo.OutOfSync, fakeargo.Progressing, fakeargo.Synced}, true, 0, false, "Synced", "Synced"},
+		{"Degraded", []fakeargo.State{fakeargo.Progressing, fakeargo.Degraded}, true, 0, false, "Degraded", "`Degraded`, please investigate"},
+		{"Stuck OutOfSync", nil, false, 0, false, "Sync timeout", "`OutOfSync`"},
+		{"Stuck Progressing", []fakeargo.State{fakeargo.Progressing}, true, 0, false, "Sync timeout", "Potential `Sync` error"},
+		{"Cancelled", []fakeargo.State{fakeargo.Progressing}, true, 0, true, "context canceled", ""},
+		{"Server error", nil, true, http.StatusInternalServerError, false, "Sync timeout", "unexpected status 500"},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			srv := fakeargo.New()
+			defer srv.Close()
+			t.Setenv("ARGOCD_SERVER", srv.URL)
+			srv.AddApp("time", deployments, v.script...)
+			srv.Fail(fakeargo.Status, v.failing)
+
+			c := newController(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if _, err := c.ForwardGitshot(ctx, strings.NewReader(`{}`)); err != nil {
+				t.Fatalf("Test %d: ForwardGitshot() error: %s", i+1, err)
+			}
+			if v.sync {
+				if _, err := c.Sync(ctx, "time"); err != nil {
+					t.Fatalf("Test %d: Sync(time) error: %s", i+1, err)
+				}
+			}
+			if v.cancel {
+				cancel()
+			}
+			var msgs []string
+			got := c.WatchSync(ctx, "time", func(msg string) { msgs = append(msgs, msg) })
+			if got != v.want {
+				t.Errorf("Test %d: WatchSync(time) got %q, want %q", i+1, got, v.want)
+			}
+			if all := strings.Join(msgs, "\n"); !strings.Contains(all, v.wantMsg) {
+				t.Errorf("Test %d: WatchSync(time) sent %q, want a message containing %q", i+1, all, v.wantMsg)
+			}
+		})
+	}
+}
+
+func TestDiffApplication(t *testing.T) {
+	srv := fakeargo.New()
+	defer srv.Close()
+	t.Setenv("ARGOCD_SERVER", srv.URL)
+	app := srv.AddApp("time", []string{"time"})
+	app.Modified = []string{"ConfigMap/time-env"}
+
+	c := newController(t)
+	modified, _, err := c.Diff(context.Background(), "time")
+	if err != nil || len(modified) != 1 || modified[0] != "ConfigMap/time-env" {
+		t.Errorf("Test 1: Diff(time) got %v, %v, want [ConfigMap/time-env]", modified, err)
+	}
+	srv.Fail(fakeargo.Diff, http.StatusForbidden)
+	if _, _, err := c.Diff(context.Background(), "time"); err == nil {
+		t.Errorf("Test 2: Diff(time) with a 403 got no error")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tt := []struct {
+		desc    string
+		jwt     string
+		failing int // Status code for userinfo
+		wantErr bool
+	}{
+		{"Logged in", "secret", 0, false},
+		{"Wrong token", "stale", 0, true},
+		{"Server error", "secret", http.StatusBadGateway, true},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			srv := fakeargo.New()
+			defer srv.Close()
+			srv.Token = "secret"
+			srv.Fail(fakeargo.UserInfo, v.failing)
+			t.Setenv("ARGOCD_SERVER", srv.URL)
+			t.Setenv("ARGOCD_JWT", v.jwt)
+
+			err := newController(t).Check(context.Background())
+			if (err != nil) != v.wantErr {
+				t.Errorf("Test %d: Check() got error %v, want error %v", i+1, err, v.wantErr)
+			}
+		})
+	}
+}
+
+// writePEM writes blocks of type typ to a file in dir, returning its path
+func writePEM(t *testing.T, dir, name, typ string, blocks ...[]byte) string {
+	t.Helper()
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b})...)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clientCert makes a self-signed client certificate, returning it and its key in DER
+func clientCert(t *testing.T) (*x509.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "deploy-bot"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, keyDER
+}
+
+func TestTLS(t *testing.T) {
+	cert, key := clientCert(t)
+	tt := []struct {
+		desc       string
+		mTLS       bool // Argo requires a client certificate
+		ca         bool // Trust Argo's certificate with ARGOCD_CA_FILE
+		clientCert bool
+		insecure   bool
+		caFile     string // Instead of Argo's certificate
+		wantNewErr bool
+		wantErr    bool
+	}{
+		{"Unknown CA", false, false, false, false, "", false, true},
+		{"Custom CA", false, true, false, false, "", false, false},
+		{"Insecure", false, false, false, true, "", false, false},
+		{"mTLS", true, true, true, false, "", false, false},
+		{"mTLS without a client certificate", true, true, false, false, "", false, true},
+		{"CA file without certificates", false, false, false, false, "not a certificate", true, false},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			var clientCAs *x509.CertPool
+			if v.mTLS {
+				clientCAs = x509.NewCertPool()
+				clientCAs.AddCert(cert)
+			}
+			srv := fakeargo.NewTLS(clientCAs)
+			defer srv.Close()
+			t.Setenv("ARGOCD_SERVER", srv.URL)
+			t.Setenv("ARGOCD_CA_FILE", "")
+			t.Setenv("ARGOCD_CLIENT_CERT", "")
+			t.Setenv("ARGOCD_CLIENT_KEY", "")
+			t.Setenv("ARGOCD_INSECURE", "")
+
+			dir := t.TempDir()
+			if v.ca {
+				t.Setenv("ARGOCD_CA_FILE", writePEM(t, dir, "ca.pem", "CERTIFICATE", srv.Certificate().Raw))
+			}
+			if v.caFile != "" {
+				path := filepath.Join(dir, "ca.pem")
+				os.WriteFile(path, []byte(v.caFile), 0600)
+				t.Setenv("ARGOCD_CA_FILE", path)
+			}
+			if v.clientCert {
+				t.Setenv("ARGOCD_CLIENT_CERT", writePEM(t, dir, "client.pem", "CERTIFICATE", cert.Raw))
+				t.Setenv("ARGOCD_CLIENT_KEY", writePEM(t, dir, "client.key", "EC PRIVATE KEY", key))
+			}
+			if v.insecure {
+				t.Setenv("ARGOCD_INSECURE", "true")
+			}
+
+			c, err := argo.New(config.Argo{})
+			if (err != nil) != v.wantNewErr {
+				t.Fatalf("Test %d: New() got error %v, want error %v", i+1, err, v.wantNewErr)
+			}
+			if err != nil {
+				return
+			}
+			err = c.Check(context.Background())
+			if (err != nil) != v.wantErr {
+				t.Errorf("Test %d: Check() got error %v, want error %v", i+1, err, v.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tt := []struct {
+		desc       string
+		env        map[string]string
+		projects   map[string]config.ArgoProject
+		appToken   string // Only token the time app accepts
+		expire     bool   // Expire sessions between the two syncs
+		rotate     string // Token to move the server and token file to between the two syncs
+		wantErr    bool   // From either sync
+		wantLogins int
+	}{
+		{"Static JWT", map[string]string{"ARGOCD_JWT": "jwt"}, nil, "", false, "", false, 0},
+		{"Session login", map[string]string{"ARGOCD_USERNAME": "bot", "ARGOCD_PASSWORD": "hunter2"}, nil, "", false, "", false, 1},
+		{"Session expired", map[string]string{"ARGOCD_USERNAME": "bot", "ARGOCD_PASSWORD": "hunter2"}, nil, "", true, "", false, 2},
+		{"Wrong password", map[string]string{"ARGOCD_USERNAME": "bot", "ARGOCD_PASSWORD": "letmein"}, nil, "", false, "", true, 0},
+		{"Rotated token file", nil, nil, "", false, "jwt2", false, 0},
+		{"Project token", map[string]string{"ARGOCD_JWT": "jwt"}, map[string]config.ArgoProject{"payments": {Apps: []string{"time"}}}, "project-jwt", false, "", false, 0},
+		{"Default token for a project's app", map[string]string{"ARGOCD_JWT": "jwt"}, nil, "project-jwt", false, "", true, 0},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			srv := fakeargo.New()
+			defer srv.Close()
+			srv.Token = "jwt"
+			srv.AddUser("bot", "hunter2")
+			srv.AddApp("time", []string{"time"}).Token = v.appToken
+			for _, k := range []string{"ARGOCD_JWT", "ARGOCD_TOKEN_FILE", "ARGOCD_USERNAME", "ARGOCD_PASSWORD", "ARGOCD_PASSWORD_FILE"} {
+				t.Setenv(k, "")
+			}
+			t.Setenv("ARGOCD_SERVER", srv.URL)
+			for k, val := range v.env {
+				t.Setenv(k, val)
+			}
+			dir := t.TempDir()
+			tokenFile := filepath.Join(dir, "token")
+			if v.rotate != "" {
+				os.WriteFile(tokenFile, []byte("jwt\n"), 0600)
+				t.Setenv("ARGOCD_TOKEN_FILE", tokenFile)
+			}
+			for name, p := range v.projects {
+				p.TokenFile = filepath.Join(dir, name)
+				os.WriteFile(p.TokenFile, []byte(v.appToken), 0600)
+				v.projects[name] = p
+			}
+
+			c, err := argo.New(config.Argo{Projects: v.projects})
+			if err != nil {
+				t.Fatalf("Test %d: New() got error %v", i+1, err)
+			}
+			_, err1 := c.Sync(context.Background(), "time")
+			if v.expire {
+				srv.ExpireSessions()
+			}
+			if v.rotate != "" {
+				srv.Token = v.rotate
+				os.WriteFile(tokenFile, []byte(v.rotate), 0600)
+			}
+			_, err2 := c.Sync(context.Background(), "time")
+			wantSyncs := 2
+			if v.wantErr {
+				wantSyncs = 0
+			}
+			if got := srv.Syncs("time"); got != wantSyncs || (err1 != nil || err2 != nil) != v.wantErr {
+				t.Errorf("Test %d: Sync(time) twice got %d syncs and errors %v, %v, want %d", i+1, got, err1, err2, wantSyncs)
+			}
+			if got := srv.Logins(); got != v.wantLogins {
+				t.Errorf("Test %d: Sync(time) twice logged in %d times, want %d", i+1, got, v.wantLogins)
+			}
+			if err := c.Check(context.Background()); (err != nil) != (v.wantErr && v.appToken == "") {
+				t.Errorf("Test %d: Check() got error %v", i+1, err)
+			}
+		})
+	}
+}
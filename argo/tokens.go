@@ -0,0 +1,255 @@
+package argo
+
+import (
+	"bytes"
+	"context"
+	"deploy-bot/config"
+	"deploy-bot/logging"
+	"deploy-bot/metrics"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// tokenSource supplies the bearer token for Argo requests
+type tokenSource interface {
+	token(ctx context.Context) (string, error)
+	// invalidate drops tok after Argo rejected it, so the next token is a fresh one
+	invalidate(tok string)
+}
+
+// staticToken is ARGOCD_JWT, which nothing can refresh
+type staticToken string
+
+func (t staticToken) token(context.Context) (string, error) { return string(t), nil }
+func (t staticToken) invalidate(string)                     {}
+
+// fileToken reads the token from a file on every request, so a rotated token mounted
+// from a secret is picked up as soon as it's written
+type fileToken string
+
+func (f fileToken) token(context.Context) (string, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("reading Argo token: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (f fileToken) invalidate(string) {}
+
+// session logs in to Argo with a username and password, holding the session token until
+// Argo rejects it
+type session struct {
+	client   *http.Client // Without the auth transport, logins don't need a token
+	username string
+	password func() (string, error)
+
+	mu  sync.Mutex
+	tok string
+}
+
+func (s *session) token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok != "" {
+		return s.tok, nil
+	}
+	password, err := s.password()
+	if err != nil {
+		return "", err
+	}
+	tok, err := login(ctx, s.client, s.username, password)
+	metrics.APIError("argo", "login", err)
+	if err != nil {
+		return "", fmt.Errorf("logging in to Argo as %s: %w", s.username, err)
+	}
+	logging.FromContext(ctx).Infof("Logged in to Argo as %s", s.username)
+	s.tok = tok
+	return tok, nil
+}
+
+func (s *session) invalidate(tok string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok == tok {
+		s.tok = ""
+	}
+}
+
+// login creates a session with POST /api/v1/session, returning its token
+func login(ctx context.Context, client *http.Client, username, password string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	url := fmt.Sprintf("%s/api/v1/session", os.Getenv("ARGOCD_SERVER"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var s struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return "", err
+	}
+	if s.Token == "" {
+		return "", errors.New("no token in session response")
+	}
+	return s.Token, nil
+}
+
+// readPassword returns the password in path, read when it's needed so it can be rotated
+func readPassword(path string) func() (string, error) {
+	return func() (string, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading Argo password: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+}
+
+// defaultSource picks how to authenticate from the environment: a token file from
+// ARGOCD_TOKEN_FILE, a session for ARGOCD_USERNAME and ARGOCD_PASSWORD, or ARGOCD_JWT
+func defaultSource(client *http.Client) tokenSource {
+	if path := os.Getenv("ARGOCD_TOKEN_FILE"); path != "" {
+		return fileToken(path)
+	}
+	if username := os.Getenv("ARGOCD_USERNAME"); username != "" {
+		password := func() (string, error) { return os.Getenv("ARGOCD_PASSWORD"), nil }
+		if path := os.Getenv("ARGOCD_PASSWORD_FILE"); path != "" {
+			password = readPassword(path)
+		}
+		return &session{client: client, username: username, password: password}
+	}
+	return staticToken(os.Getenv("ARGOCD_JWT"))
+}
+
+// projectSource builds the token source for one Argo project from the config
+func projectSource(client *http.Client, name string, p config.ArgoProject) (tokenSource, error) {
+	switch {
+	case p.TokenFile != "" && p.Username != "":
+		return nil, fmt.Errorf("Argo project %s has both token_file and username", name)
+	case p.TokenFile != "":
+		return fileToken(p.TokenFile), nil
+	case p.Username != "" && p.PasswordFile != "":
+		return &session{client: client, username: p.Username, password: readPassword(p.PasswordFile)}, nil
+	default:
+		return nil, fmt.Errorf("Argo project %s needs token_file, or username and password_file", name)
+	}
+}
+
+// tokens holds the default token source and one per Argo project, with the
+// project each app belongs to
+type tokens struct {
+	fallback tokenSource
+	projects map[string]tokenSource
+	apps     map[string]string // App to project
+}
+
+func newTokens(client *http.Client, cfg config.Argo) (*tokens, error) {
+	t := &tokens{
+		fallback: defaultSource(client),
+		projects: make(map[string]tokenSource),
+		apps:     make(map[string]string),
+	}
+	for name, p := range cfg.Projects {
+		src, err := projectSource(client, name, p)
+		if err != nil {
+			return nil, err
+		}
+		t.projects[name] = src
+		for _, app := range p.Apps {
+			if other, ok := t.apps[app]; ok {
+				return nil, fmt.Errorf("app %s is in both Argo projects %s and %s", app, other, name)
+			}
+			t.apps[app] = name
+		}
+	}
+	return t, nil
+}
+
+// source returns the token source for a request: the project set on its context,
+// else the project of the app in its path, else the default
+func (t *tokens) source(r *http.Request) tokenSource {
+	project, ok := r.Context().Value(projectKey{}).(string)
+	if !ok {
+		project = t.apps[appFromPath(r.URL.Path)]
+	}
+	if src, ok := t.projects[project]; ok {
+		return src
+	}
+	return t.fallback
+}
+
+// appFromPath returns the app in /api/v1/applications/<app>/..., or ""
+func appFromPath(path string) string {
+	rest := strings.TrimPrefix(path, "/api/v1/applications/")
+	if rest == path {
+		return ""
+	}
+	return strings.SplitN(rest, "/", 2)[0]
+}
+
+type projectKey struct{}
+
+// withProject makes requests under ctx use the project's token whatever the path
+func withProject(ctx context.Context, project string) context.Context {
+	return context.WithValue(ctx, projectKey{}, project)
+}
+
+// authTransport adds the right bearer token to every request, logging in again and
+// retrying once when Argo answers 401 to a token that can be refreshed
+type authTransport struct {
+	base   http.RoundTripper
+	tokens *tokens
+}
+
+func (t *authTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	src := t.tokens.source(r)
+	tok, err := src.token(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(authorize(r, tok))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	src.invalidate(tok)
+	fresh, err := src.token(r.Context())
+	if err != nil || fresh == tok || (r.Body != nil && r.GetBody == nil) {
+		return resp, nil // Nothing new to try, or no way to send the body again
+	}
+	logging.FromContext(r.Context()).Infof("Argo rejected its token for %s, retrying with a new one", r.URL.Path)
+	retry := authorize(r, fresh)
+	if r.GetBody != nil {
+		if retry.Body, err = r.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return t.base.RoundTrip(retry)
+}
+
+// authorize returns a copy of r carrying tok, leaving r as it was as RoundTrippers must
+func authorize(r *http.Request, tok string) *http.Request {
+	r = r.Clone(r.Context())
+	r.Header.Del("Authorization")
+	if tok != "" {
+		r.Header.Set("Authorization", "Bearer "+tok)
+	}
+	return r
+}
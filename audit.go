@@ -0,0 +1,101 @@
+package main
+
+import (
+	"deploy-bot/audit"
+	"deploy-bot/auth"
+	"deploy-bot/logging"
+	slackbot "deploy-bot/slack"
+	"fmt"
+	"os"
+)
+
+// auditEvent appends to the audit log, which is never allowed to stop the bot doing its job
+func (b *Bot) auditEvent(e audit.Entry) {
+	if b.Audit == nil {
+		return
+	}
+	if err := b.Audit.Record(e); err != nil {
+		logging.Errorf("Error writing audit log entry %s: %s", e, err)
+	}
+}
+
+// can checks user holds role for app in env, auditing the decision
+func (b *Bot) can(user, app, env string, role auth.Role) bool {
+	allowed := b.Authz.Can(user, app, env, role)
+	outcome := "allowed"
+	if !allowed {
+		outcome = "denied"
+	}
+	b.auditEvent(audit.Entry{
+		Actor:   user,
+		Action:  "authorize",
+		App:     app,
+		Env:     env,
+		Outcome: outcome,
+		Detail:  fmt.Sprintf("requires %s", role),
+	})
+	return allowed
+}
+
+// forwarded are the actions posted to AUDIT_CHANNEL, those that change something. Mentions,
+// authorization checks and the steps within a deploy only go to the file
+var forwarded = map[string]bool{
+	"deploy":          true,
+	"approval":        true,
+	"cancel":          true,
+	"lock":            true,
+	"unlock":          true,
+	"freeze":          true,
+	"unfreeze":        true,
+	"freeze-override": true,
+}
+
+// openAuditLog opens the log at AUDIT_LOG, forwarding changes to AUDIT_CHANNEL when it is set
+func openAuditLog() *audit.Log {
+	path := os.Getenv("AUDIT_LOG")
+	if path == "" {
+		path = "audit.log"
+	}
+	l, err := audit.Open(path)
+	if err != nil {
+		logging.Fatalf("Error opening audit log: %s", err)
+	}
+	if channel := os.Getenv("AUDIT_CHANNEL"); channel != "" {
+		connInfo := slackbot.ConnInfo{Client: slackbot.Client(), Channel: channel}
+		l.Forward = func(e audit.Entry) {
+			if !forwarded[e.Action] {
+				return
+			}
+			slackbot.SendMessage(connInfo, e.String())
+		}
+	}
+	return l
+}
+
+// auditCommand implements `deploy-bot audit verify [path]`, exiting non-zero if the chain is broken
+func auditCommand(args []string) {
+	if len(args) < 1 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: deploy-bot audit verify [path]")
+		os.Exit(2)
+	}
+	path := os.Getenv("AUDIT_LOG")
+	if len(args) > 1 {
+		path = args[1]
+	}
+	if path == "" {
+		path = "audit.log"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	n, err := audit.Verify(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: chain broken after %d good entries: %s\n", path, n, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %d entries verified\n", path, n)
+}
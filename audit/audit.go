@@ -0,0 +1,172 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"deploy-bot/logging"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is one line of the audit log. Hash covers every other field, including
+// PrevHash, so changing or removing any line breaks the chain after it
+type Entry struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"` // Slack user ID, or "deploy-bot"
+	Action   string    `json:"action"`
+	Channel  string    `json:"channel,omitempty"`
+	App      string    `json:"app,omitempty"`
+	Env      string    `json:"env,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Detail   string    `json:"detail,omitempty"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+func (e Entry) computeHash() string {
+	e.Hash = ""
+	buf, _ := json.Marshal(e)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func (e Entry) String() string {
+	s := fmt.Sprintf("#%d %s <@%s> %s", e.Seq, e.Time.Format(time.RFC3339), e.Actor, e.Action)
+	if e.App != "" {
+		s += fmt.Sprintf(" `%s`", e.App)
+	}
+	if e.Env != "" {
+		s += fmt.Sprintf(" (%s)", e.Env)
+	}
+	s += ": " + e.Outcome
+	if e.Detail != "" {
+		s += fmt.Sprintf(" — %s", e.Detail)
+	}
+	return s
+}
+
+// Log appends hash-chained JSON lines to a file
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	last string
+
+	// Forward, if set, is called with every entry after it is written
+	Forward func(e Entry)
+}
+
+// Open opens the log at path for appending, verifying the existing chain so new
+// entries carry on from the last one. A broken chain is refused rather than extended,
+// but a last line torn by a crash mid-write is dropped with a warning
+func Open(path string) (*Log, error) {
+	l := &Log{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	intact := intactLength(data)
+	last, err := verify(bytes.NewReader(data[:intact]))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	l.seq, l.last = last.Seq, last.Hash
+	if intact < len(data) {
+		logging.Warnf("Audit log %s ends in a partial entry after #%d, probably from a crash while writing it; dropping %d bytes", path, last.Seq, len(data)-intact)
+		if err := os.Truncate(path, int64(intact)); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.f = f
+	return l, nil
+}
+
+// intactLength is how much of data to keep: all of it, unless the last line is missing its
+// newline or isn't JSON, which is what an interrupted Record leaves behind
+func intactLength(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	if data[len(data)-1] != '\n' {
+		return bytes.LastIndexByte(data, '\n') + 1
+	}
+	start := bytes.LastIndexByte(data[:len(data)-1], '\n') + 1
+	if !json.Valid(data[start : len(data)-1]) {
+		return start
+	}
+	return len(data)
+}
+
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// Record chains e onto the log and writes it out, filling in Seq, Time and the hashes
+func (l *Log) Record(e Entry) error {
+	l.mu.Lock()
+	l.seq++
+	e.Seq = l.seq
+	e.Time = time.Now().UTC()
+	e.PrevHash = l.last
+	e.Hash = e.computeHash()
+	buf, _ := json.Marshal(e)
+	_, err := l.f.Write(append(buf, '\n'))
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		// Don't leave a gap in the chain for an entry that may not have landed
+		l.seq--
+		l.mu.Unlock()
+		return err
+	}
+	l.last = e.Hash
+	l.mu.Unlock()
+
+	if l.Forward != nil {
+		l.Forward(e)
+	}
+	return nil
+}
+
+// Verify checks every entry read from r chains onto the one before it,
+// returning how many entries were verified
+func Verify(r io.Reader) (int64, error) {
+	last, err := verify(r)
+	return last.Seq, err
+}
+
+func verify(r io.Reader) (Entry, error) {
+	var last Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return last, fmt.Errorf("line %d: %s", line, err)
+		}
+		if e.Seq != last.Seq+1 {
+			return last, fmt.Errorf("line %d: sequence %d follows %d", line, e.Seq, last.Seq)
+		}
+		if e.PrevHash != last.Hash {
+			return last, fmt.Errorf("line %d: previous hash does not match entry %d", line, last.Seq)
+		}
+		if e.computeHash() != e.Hash {
+			return last, fmt.Errorf("line %d: hash does not match its contents", line)
+		}
+		last = e
+	}
+	return last, scanner.Err()
+}
@@ -0,0 +1,105 @@
+package audit_test
+
+import (
+	"bytes"
+	"deploy-bot/audit"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := audit.Open(path)
+	if err != nil {
+		t.Fatalf("Open() error: %s", err)
+	}
+	for _, action := range []string{"mention", "lock", "deploy"} {
+		if err := l.Record(audit.Entry{Actor: "U1", Action: action, App: "time", Outcome: "ok"}); err != nil {
+			t.Fatalf("Record(%s) error: %s", action, err)
+		}
+	}
+	l.Close()
+
+	// Reopening carries on the chain from the last entry
+	l, err = audit.Open(path)
+	if err != nil {
+		t.Fatalf("Open() existing log error: %s", err)
+	}
+	l.Record(audit.Entry{Actor: "U2", Action: "unlock", App: "time", Outcome: "ok"})
+	l.Close()
+
+	buf, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(string(bytes.TrimSpace(buf)), "\n")
+
+	tt := []struct {
+		desc    string
+		log     string
+		wantN   int64
+		wantErr bool
+	}{
+		{"Intact", string(buf), 4, false},
+		{"Empty", "", 0, false},
+		{"Edited entry", strings.Replace(string(buf), `"U2"`, `"U3"`, 1), 3, true},
+		{"Removed entry", lines[0] + lines[2] + lines[3], 1, true},
+		{"Truncated", lines[0] + lines[1], 2, false},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			n, err := audit.Verify(strings.NewReader(v.log))
+			if n != v.wantN || (err != nil) != v.wantErr {
+				t.Errorf("Test %d: Verify(%s) got %d, %v, want %d, error %v", i+1, v.desc, n, err, v.wantN, v.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenBrokenChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, _ := audit.Open(path)
+	l.Record(audit.Entry{Actor: "U1", Action: "lock", Outcome: "locked"})
+	l.Close()
+
+	buf, _ := os.ReadFile(path)
+	os.WriteFile(path, bytes.Replace(buf, []byte("locked"), []byte("unlocked"), 1), 0600)
+	if _, err := audit.Open(path); err == nil {
+		t.Errorf("Open() of tampered log got nil error, want error")
+	}
+}
+
+func TestOpenTornEntry(t *testing.T) {
+	tt := []struct {
+		desc string
+		torn string
+	}{
+		{"No newline", `{"seq":3,"time":"2026-`},
+		{"Not JSON", "{\"seq\":3,\"ti\x00\n"},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			l, _ := audit.Open(path)
+			l.Record(audit.Entry{Actor: "U1", Action: "lock", Outcome: "locked"})
+			l.Record(audit.Entry{Actor: "U1", Action: "unlock", Outcome: "unlocked"})
+			l.Close()
+			f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+			f.WriteString(v.torn)
+			f.Close()
+
+			l, err := audit.Open(path)
+			if err != nil {
+				t.Fatalf("Test %d: Open() of a log with a torn last line error: %s", i+1, err)
+			}
+			if err := l.Record(audit.Entry{Actor: "U2", Action: "lock", Outcome: "locked"}); err != nil {
+				t.Fatalf("Test %d: Record() error: %s", i+1, err)
+			}
+			l.Close()
+			f, _ = os.Open(path)
+			defer f.Close()
+			if n, err := audit.Verify(f); n != 3 || err != nil {
+				t.Errorf("Test %d: Verify() after reopening got %d, %v, want 3 entries", i+1, n, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"deploy-bot/config"
+	"deploy-bot/logging"
+	"deploy-bot/util"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Roles are ordered, each one can do everything the roles below it can
+type Role int
+
+const (
+	None     Role = iota
+	Viewer        // plan, queue, history
+	Deployer      // deploy, lock and cancel their own deploys
+	Approver      // approve other people's deploys
+	Admin         // override locks, cancel anyone's deploys
+)
+
+var roleNames = []string{"none", "viewer", "deployer", "approver", "admin"}
+
+func (r Role) String() string {
+	if r < None || r > Admin {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+func ParseRole(s string) (Role, error) {
+	for i, name := range roleNames {
+		if name == s {
+			return Role(i), nil
+		}
+	}
+	return None, fmt.Errorf("unknown role %q", s)
+}
+
+// How long Slack user group memberships are cached
+const GroupCacheTTL = 5 * time.Minute
+
+// MembersFunc lists the user IDs in a Slack user group, i.e. usergroups.users.list
+type MembersFunc func(group string) ([]string, error)
+
+type grant struct {
+	role Role
+	config.Grant
+}
+
+type cachedGroup struct {
+	members map[string]bool
+	fetched time.Time
+}
+
+type Authorizer struct {
+	legacy  bool
+	grants  []grant
+	members MembersFunc
+
+	mu     sync.Mutex
+	groups map[string]cachedGroup
+}
+
+// New builds an Authorizer from the grants in config, failing on a grant with an unknown
+// role rather than leaving it out. With no grants at all the legacy env vars are used instead:
+// ADMIN_USERS are admins, only AUTHORIZED_USERS may deploy to and approve deploys in
+// production, and everybody may deploy elsewhere
+func New(grants []config.Grant, members MembersFunc) (*Authorizer, error) {
+	a := &Authorizer{
+		legacy:  len(grants) == 0,
+		members: members,
+		groups:  make(map[string]cachedGroup),
+	}
+	for i, g := range grants {
+		role, err := ParseRole(g.Role)
+		if err != nil {
+			return nil, fmt.Errorf("RBAC grant %d: %w", i+1, err)
+		}
+		a.grants = append(a.grants, grant{role: role, Grant: g})
+	}
+	return a, nil
+}
+
+// RoleFor returns the highest role user holds for app in env.
+// An empty app matches only grants that aren't limited to particular apps
+func (a *Authorizer) RoleFor(user, app, env string) Role {
+	if a.legacy {
+		return legacyRole(user, env)
+	}
+	role := None
+	for _, g := range a.grants {
+		if g.role <= role || !matches(g.Apps, app) || !matches(g.Environments, env) {
+			continue
+		}
+		if contains(g.Users, user) || a.inGroups(g.Groups, user) {
+			role = g.role
+		}
+	}
+	return role
+}
+
+func (a *Authorizer) Can(user, app, env string, role Role) bool {
+	return a.RoleFor(user, app, env) >= role
+}
+
+func legacyRole(user, env string) Role {
+	switch {
+	case util.IsAdmin(user):
+		return Admin
+	case util.AuthorizeUser(user):
+		return Approver
+	case env != "production":
+		return Deployer
+	default:
+		return Viewer
+	}
+}
+
+func (a *Authorizer) inGroups(groups []string, user string) bool {
+	for _, g := range groups {
+		if a.groupMembers(g)[user] {
+			return true
+		}
+	}
+	return false
+}
+
+// groupMembers returns the cached members of group, refreshing them after GroupCacheTTL.
+// If Slack can't be reached the stale members are used rather than locking everybody out
+func (a *Authorizer) groupMembers(group string) map[string]bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cached, ok := a.groups[group]
+	if ok && time.Since(cached.fetched) < GroupCacheTTL {
+		return cached.members
+	}
+	if a.members == nil {
+		return cached.members
+	}
+
+	users, err := a.members(group)
+	if err != nil {
+		logging.Errorf("Error listing members of user group %s: %s", group, err)
+		return cached.members
+	}
+	members := make(map[string]bool, len(users))
+	for _, u := range users {
+		members[u] = true
+	}
+	a.groups[group] = cachedGroup{members: members, fetched: time.Now()}
+	return members
+}
+
+func matches(allowed []string, s string) bool {
+	return len(allowed) == 0 || contains(allowed, s)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package auth_test
+
+import (
+	"deploy-bot/auth"
+	"deploy-bot/config"
+	"testing"
+)
+
+func TestRoleFor(t *testing.T) {
+	grants := []config.Grant{
+		{Role: "viewer", Groups: []string{"S_ENG"}},
+		{Role: "deployer", Groups: []string{"S_PAYMENTS"}, Apps: []string{"sales"}},
+		{Role: "deployer", Users: []string{"U_DEV"}, Environments: []string{"staging"}},
+		{Role: "approver", Users: []string{"U_LEAD"}, Apps: []string{"sales", "accounts"}, Environments: []string{"production"}},
+		{Role: "admin", Users: []string{"U_ADMIN"}},
+	}
+	members := func(group string) ([]string, error) {
+		return map[string][]string{
+			"S_ENG":      {"U_PAY", "U_DEV", "U_LEAD"},
+			"S_PAYMENTS": {"U_PAY"},
+		}[group], nil
+	}
+	a, err := auth.New(grants, members)
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+
+	tt := []struct {
+		desc string
+		user string
+		app  string
+		env  string
+		want auth.Role
+	}{
+		{"Payments can deploy sales to production", "U_PAY", "sales", "production", auth.Deployer},
+		{"Payments can only view accounts", "U_PAY", "accounts", "production", auth.Viewer},
+		{"App-less check ignores app-scoped grants", "U_PAY", "", "production", auth.Viewer},
+		{"Dev can deploy anything to staging", "U_DEV", "accounts", "staging", auth.Deployer},
+		{"Dev can only view production", "U_DEV", "accounts", "production", auth.Viewer},
+		{"Lead approves sales in production", "U_LEAD", "sales", "production", auth.Approver},
+		{"Lead only views time", "U_LEAD", "time", "production", auth.Viewer},
+		{"Admin everywhere", "U_ADMIN", "time", "production", auth.Admin},
+		{"Stranger", "U8675309", "time", "staging", auth.None},
+	}
+	for i, r := range tt {
+		t.Run(r.desc, func(t *testing.T) {
+			got := a.RoleFor(r.user, r.app, r.env)
+			if got != r.want {
+				t.Errorf("Test %d: RoleFor(%s,%s,%s) got %v, want %v", i+1, r.user, r.app, r.env, got, r.want)
+			}
+		})
+	}
+}
+
+func TestLegacyRole(t *testing.T) {
+	t.Setenv("ADMIN_USERS", "U_ADMIN")
+	t.Setenv("AUTHORIZED_USERS", "U_LEAD,U_DEV")
+	a, err := auth.New(nil, nil)
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+
+	tt := []struct {
+		desc string
+		user string
+		env  string
+		want auth.Role
+	}{
+		{"Authorized users approve production", "U_LEAD", "production", auth.Approver},
+		{"Authorized users approve elsewhere too", "U_DEV", "staging", auth.Approver},
+		{"Others only view production", "U8675309", "production", auth.Viewer},
+		{"Others deploy elsewhere", "U8675309", "staging", auth.Deployer},
+		{"Admin everywhere", "U_ADMIN", "production", auth.Admin},
+	}
+	for i, r := range tt {
+		t.Run(r.desc, func(t *testing.T) {
+			got := a.RoleFor(r.user, "time", r.env)
+			if got != r.want {
+				t.Errorf("Test %d: RoleFor(%s,time,%s) got %v, want %v", i+1, r.user, r.env, got, r.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tt := []struct {
+		desc    string
+		grants  []config.Grant
+		wantErr bool
+	}{
+		{"Legacy", nil, false},
+		{"Known roles", []config.Grant{{Role: "viewer", Users: []string{"U_DEV"}}, {Role: "admin", Users: []string{"U_ADMIN"}}}, false},
+		{"One unknown role", []config.Grant{{Role: "viewer", Users: []string{"U_DEV"}}, {Role: "superuser", Users: []string{"U_DEV"}}}, true},
+		{"Only unknown roles", []config.Grant{{Role: "deployers", Users: []string{"U_DEV"}}}, true},
+	}
+	for i, c := range tt {
+		t.Run(c.desc, func(t *testing.T) {
+			_, err := auth.New(c.grants, nil)
+			if (err != nil) != c.wantErr {
+				t.Errorf("Test %d: New() got error %v, want error %v", i+1, err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"deploy-bot/auth"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/util"
+	"fmt"
+)
+
+// authorize checks user holds role for app in the channel's environment, telling them when they don't
+func (b *Bot) authorize(user, app string, role auth.Role, connInfo slackbot.ConnInfo) bool {
+	return b.authorizeIn(user, app, util.GetEnvironment(connInfo.Channel), role, connInfo)
+}
+
+// authorizeIn is authorize for an environment other than the channel's, e.g. a queued deploy's
+func (b *Bot) authorizeIn(user, app, env string, role auth.Role, connInfo slackbot.ConnInfo) bool {
+	if b.can(user, app, env, role) {
+		return true
+	}
+	scope := env
+	if app != "" {
+		scope = fmt.Sprintf("`%s` in %s", app, env)
+	}
+	msg := fmt.Sprintf("_あなたはふさわしくない, translation: you need the %s role for %s_", role, scope)
+	b.Slack.SendMessage(connInfo, msg)
+	return false
+}
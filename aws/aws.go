@@ -2,53 +2,65 @@ package aws
 
 import (
 	"context"
-	"deploy-bot/util"
+	"deploy-bot/metrics"
+	"deploy-bot/tracing"
+	"fmt"
+	awssdk "github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
-	"github.com/google/go-github/v40/github"
-	"log"
+	"net/http"
+	"os"
 )
 
 func ecrSession() *ecr.ECR {
-	sess := session.Must(session.NewSession())
+	traced := &http.Client{Transport: tracing.Transport("ecr", http.DefaultTransport)}
+	sess := session.Must(session.NewSession(&awssdk.Config{HTTPClient: traced}))
 	return ecr.New(sess)
 }
 
-func getEcrImages(svc *ecr.ECR, app string) (*ecr.ListImagesOutput, error) {
+func getEcrImages(ctx context.Context, svc *ecr.ECR, app string) (*ecr.ListImagesOutput, error) {
 	input := ecr.ListImagesInput{RepositoryName: &app}
-	images, err := svc.ListImages(&input)
+	images, err := svc.ListImagesWithContext(ctx, &input)
 	return images, err
 }
 
-// Checks to ensure the image exists in ECR
-func ConfirmImageExists(ctx context.Context, client *github.Client, pr *github.PullRequest, app string) (bool, string, string) {
-	svc := ecrSession()
-	var imgTag *string
-	var sha string
-
-	// pr will be nil if anything other than a positive int was presented as 2nd slackbot arg
-	// so then we get the HEAD commit on main
-	if pr == nil {
-		opts := &github.CommitsListOptions{SHA: "main"}
-		repoCommits, _, _ := client.Repositories.ListCommits(ctx, util.Owner, app, opts)
-		imgTag = util.BuildDockerImageString("main", *repoCommits[0].SHA)
-		sha = *repoCommits[0].SHA
-	} else {
-		ref := pr.Head.GetRef()
-		sha = pr.Head.GetSHA()
-		imgTag = util.BuildDockerImageString(ref, sha)
+// ImageURL links to the app's image repository in the ECR console, filtered to tag
+func ImageURL(app, tag string) string {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
 	}
+	return fmt.Sprintf("https://console.aws.amazon.com/ecr/repositories/%s/?region=%s&tag=%s", app, region, tag)
+}
+
+// ECR is the live pipeline.ImageRegistry, with a repository per app
+type ECR struct {
+	svc *ecr.ECR
+}
+
+func NewECR() *ECR {
+	return &ECR{svc: ecrSession()}
+}
+
+// Check is the readiness check for ECR, confirming the AWS credentials are accepted
+func (e *ECR) Check(ctx context.Context) error {
+	_, err := e.svc.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
+	metrics.APIError("ecr", "get_authorization_token", err)
+	return err
+}
 
-	images, err := getEcrImages(svc, app)
+// ImageExists checks the tag has been pushed to the app's repository
+func (e *ECR) ImageExists(ctx context.Context, app, tag string) (bool, error) {
+	images, err := getEcrImages(ctx, e.svc, app)
+	metrics.APIError("ecr", "list_images", err)
 	// TODO: include list of available images for given app?
 	if err != nil {
-		log.Printf("Error: %v", err)
+		return false, err
 	}
-
 	for _, img := range images.ImageIds {
-		if *img.ImageTag == *imgTag {
-			return true, *imgTag, sha
+		if img.ImageTag != nil && *img.ImageTag == tag {
+			return true, nil
 		}
 	}
-	return false, *imgTag, sha
+	return false, nil
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"deploy-bot/approval"
+	"deploy-bot/audit"
+	"deploy-bot/auth"
+	"deploy-bot/dedup"
+	"deploy-bot/lock"
+	"deploy-bot/pipeline"
+	"deploy-bot/queue"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"sync"
+
+	"github.com/slack-go/slack"
+)
+
+// Notifier posts to Slack threads
+type Notifier interface {
+	SendMessage(conn slackbot.ConnInfo, msg string)
+	// PostBlocks returns the message's timestamp so it can be updated
+	PostBlocks(conn slackbot.ConnInfo, fallback string, blocks ...slack.Block) (string, error)
+	UpdateBlocks(conn slackbot.ConnInfo, ts, fallback string, blocks ...slack.Block) error
+	Permalink(conn slackbot.ConnInfo) string
+	UserName(user string) string
+}
+
+// Services are everything outside the bot that a deploy talks to
+type Services struct {
+	Repo     pipeline.SourceRepo
+	Registry pipeline.ImageRegistry
+	GitOps   pipeline.GitOpsStore
+	CD       pipeline.CDController
+	Slack    Notifier
+}
+
+// Bot handles mentions, interactions and githooks, holding the state shared between deploys
+type Bot struct {
+	Services
+
+	Locks     *lock.Manager
+	Deploys   *queue.Queue
+	History   *store.Store
+	Authz     *auth.Authorizer
+	Approvals *approval.Manager
+	Audit     *audit.Log // Nil when not auditing
+
+	events *dedup.Cache
+	// Deploys waiting on the githook for their commit, keyed by app like the queue, so
+	// there is only ever one per app whichever environment it deploys to
+	hookWaiters sync.Map
+	// Deploys that are running, keyed by ID, so they can be cancelled
+	running sync.Map
+	// Mentions, githooks and deploys being worked on, which shutdown waits for
+	inflight inflight
+
+	// ctx is the parent of every deploy's context, cancelled when the bot shuts down
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+func NewBot(svc Services, history *store.Store, authz *auth.Authorizer) *Bot {
+	ctx, stop := context.WithCancel(context.Background())
+	return &Bot{
+		Services:  svc,
+		Locks:     lock.NewManager(),
+		Deploys:   queue.New(),
+		History:   history,
+		Authz:     authz,
+		Approvals: approval.NewManager(),
+		events:    dedup.New(dedup.DefaultTTL),
+		ctx:       ctx,
+		stop:      stop,
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"deploy-bot/argo"
+	"deploy-bot/aws"
+	"deploy-bot/github"
+	"deploy-bot/logging"
+	"deploy-bot/pipeline"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"deploy-bot/tracing"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Checklist marks for each stage of the status card
+const (
+	markPending = "◻️"
+	markRunning = "⏳"
+	markDone    = "✓"
+	markFailed  = "✗"
+	markSkipped = "↷" // Finished before the bot restarted
+)
+
+// statusCard is the one message a deploy posts to its thread, edited in place as
+// the pipeline runs rather than replying for every step
+type statusCard struct {
+	mu        sync.Mutex
+	slack     Notifier
+	connInfo  slackbot.ConnInfo
+	ts        string // Empty until posted, or if posting failed
+	record    *store.Deploy
+	stages    []string
+	marks     map[string]string
+	durations map[string]time.Duration
+	note      string
+	banner    string
+	links     []string
+	trace     string // ID of the deploy's trace
+	log       *logging.Logger
+}
+
+func newStatusCard(notifier Notifier, record *store.Deploy, connInfo slackbot.ConnInfo, stages []string) *statusCard {
+	c := &statusCard{
+		slack:     notifier,
+		connInfo:  connInfo,
+		record:    record,
+		stages:    stages,
+		marks:     make(map[string]string),
+		durations: make(map[string]time.Duration),
+		log:       deployLogger(record),
+	}
+	for _, stage := range stages {
+		c.marks[stage] = markPending
+	}
+	return c
+}
+
+// resumeFrom marks the stages before from as done by the deploy's previous run
+func (c *statusCard) resumeFrom(from string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, stage := range c.stages {
+		if stage == from {
+			return
+		}
+		c.marks[stage] = markSkipped
+	}
+}
+
+func (c *statusCard) start(stage string) {
+	c.mu.Lock()
+	c.marks[stage] = markRunning
+	c.mu.Unlock()
+	c.update()
+}
+
+func (c *statusCard) finish(t pipeline.Timing, err error) {
+	c.mu.Lock()
+	c.marks[t.Stage] = markDone
+	if err != nil {
+		c.marks[t.Stage] = markFailed
+	}
+	c.durations[t.Stage] = t.Duration
+	c.mu.Unlock()
+	c.update()
+}
+
+// notify shows msg as the latest progress on the card
+func (c *statusCard) notify(msg string) {
+	c.mu.Lock()
+	c.note = msg
+	posted := c.ts != ""
+	c.mu.Unlock()
+	if !posted {
+		// Better a reply than losing the message
+		c.slack.SendMessage(c.connInfo, msg)
+		return
+	}
+	c.update()
+}
+
+// setLinks picks up whatever the pipeline has found out so far
+func (c *statusCard) setLinks(s *pipeline.State) {
+	var links []string
+	if s.PR != nil {
+		links = append(links, fmt.Sprintf("<%s|PR #%d>", s.PR.GetHTMLURL(), s.PR.GetNumber()))
+	}
+	if s.ImageTag != "" {
+		links = append(links, fmt.Sprintf("<%s|Image `%s`>", aws.ImageURL(s.App, s.ImageTag), s.ImageTag))
+	}
+	if s.GitopsCommit != "" {
+		links = append(links, fmt.Sprintf("<%s|Gitops commit `%.7s`>", github.GitopsCommitURL(s.GitopsCommit), s.GitopsCommit))
+	}
+	if s.App != "" {
+		links = append(links, fmt.Sprintf("<%s|Argo CD>", argo.AppURL(s.App)))
+	}
+	if url := tracing.URL(c.trace); url != "" {
+		links = append(links, fmt.Sprintf("<%s|Trace `%s`>", url, c.trace))
+	} else if c.trace != "" {
+		links = append(links, fmt.Sprintf("Trace `%s`", c.trace))
+	}
+	c.mu.Lock()
+	c.links = links
+	c.mu.Unlock()
+}
+
+// succeed and fail put the final banner on the card
+func (c *statusCard) succeed(result string) {
+	c.mu.Lock()
+	c.banner = fmt.Sprintf(":white_check_mark: *Deploy #%d of `%s` to %s finished: %s*", c.record.ID, c.record.App, c.record.Environment, result)
+	c.note = ""
+	c.mu.Unlock()
+	c.update()
+}
+
+func (c *statusCard) fail(se *pipeline.StageError) {
+	c.mu.Lock()
+	c.banner = fmt.Sprintf(":x: *Deploy #%d of `%s` to %s failed at %s*", c.record.ID, c.record.App, c.record.Environment, se.Stage)
+	if se.Msg != "" {
+		c.note = se.Msg
+	}
+	posted := c.ts != ""
+	c.mu.Unlock()
+	c.update()
+	if !posted && se.Msg != "" {
+		c.slack.SendMessage(c.connInfo, se.Msg)
+	}
+}
+
+func (c *statusCard) blocks() []slack.Block {
+	header := fmt.Sprintf("*Deploy #%d* of `%s` %s to %s, requested by <@%s>",
+		c.record.ID, c.record.App, c.record.Ref, c.record.Environment, c.record.Requester)
+	blocks := []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject("mrkdwn", header, false, false), nil, nil),
+	}
+	if c.banner != "" {
+		blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject("mrkdwn", c.banner, false, false), nil, nil))
+	}
+
+	lines := make([]string, len(c.stages))
+	for i, stage := range c.stages {
+		lines[i] = fmt.Sprintf("%s %s", c.marks[stage], stage)
+		if d, ok := c.durations[stage]; ok {
+			lines[i] += fmt.Sprintf(" _(%s)_", d.Round(100*time.Millisecond))
+		}
+	}
+	blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject("mrkdwn", strings.Join(lines, "\n"), false, false), nil, nil))
+
+	if c.note != "" {
+		blocks = append(blocks, slack.NewContextBlock("", slack.NewTextBlockObject("mrkdwn", c.note, false, false)))
+	}
+	if len(c.links) > 0 {
+		blocks = append(blocks, slack.NewContextBlock("", slack.NewTextBlockObject("mrkdwn", strings.Join(c.links, " · "), false, false)))
+	}
+	return blocks
+}
+
+// update posts the card the first time and edits it after that
+func (c *statusCard) update() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fallback := fmt.Sprintf("Deploy #%d of %s to %s", c.record.ID, c.record.App, c.record.Environment)
+	if c.ts == "" {
+		ts, err := c.slack.PostBlocks(c.connInfo, fallback, c.blocks()...)
+		if err != nil {
+			c.log.Errorf("Error posting status card for deploy #%d: %s", c.record.ID, err)
+			return
+		}
+		c.ts = ts
+		return
+	}
+	if err := c.slack.UpdateBlocks(c.connInfo, c.ts, fallback, c.blocks()...); err != nil {
+		c.log.Errorf("Error updating status card for deploy #%d: %s", c.record.ID, err)
+	}
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"deploy-bot/logging"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// StageConfig declares a custom pipeline stage for an app, positioned
+// before or after one of the built-in (or earlier custom) stages
+type StageConfig struct {
+	Name    string            `yaml:"name"`
+	Type    string            `yaml:"type"`
+	Before  string            `yaml:"before,omitempty"`
+	After   string            `yaml:"after,omitempty"`
+	URL     string            `yaml:"url,omitempty"`
+	Timeout int               `yaml:"timeout,omitempty"` // Seconds
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// Grant gives a role to Slack users and user groups, optionally limited to some
+// apps and environments. Empty Apps or Environments match every app or environment
+type Grant struct {
+	Role         string   `yaml:"role"`
+	Users        []string `yaml:"users,omitempty"`  // Slack user IDs
+	Groups       []string `yaml:"groups,omitempty"` // Slack user group IDs
+	Apps         []string `yaml:"apps,omitempty"`
+	Environments []string `yaml:"environments,omitempty"`
+}
+
+type RBAC struct {
+	Grants []Grant `yaml:"grants"`
+}
+
+// Approval lists the environments where deploys need a second person to approve them
+type Approval struct {
+	Environments []string `yaml:"environments"` // Defaults to production
+	Expiry       int      `yaml:"expiry"`       // Minutes, defaults to 30
+}
+
+func (a Approval) RequiredFor(env string) bool {
+	envs := a.Environments
+	if envs == nil {
+		envs = []string{"production"}
+	}
+	for _, e := range envs {
+		if e == env {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Approval) ExpiryDuration() time.Duration {
+	if a.Expiry <= 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(a.Expiry) * time.Minute
+}
+
+// FreezeWindow is a recurring blackout, e.g. Friday after 15:00 or all weekend.
+// Start and End are "15:04" in Freezes.Timezone and default to the whole day;
+// an End before Start runs over midnight
+type FreezeWindow struct {
+	Name         string   `yaml:"name"`
+	Environments []string `yaml:"environments,omitempty"` // Empty matches every environment
+	Days         []string `yaml:"days"`                   // monday, tuesday, ...
+	Start        string   `yaml:"start,omitempty"`
+	End          string   `yaml:"end,omitempty"`
+}
+
+type Freezes struct {
+	Timezone string         `yaml:"timezone"` // Defaults to UTC
+	Windows  []FreezeWindow `yaml:"windows"`
+}
+
+func (f Freezes) Location() *time.Location {
+	loc, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		logging.Errorf("Error loading freeze timezone %q, using UTC: %s", f.Timezone, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// Timeouts bound how long a deploy may run. A stage that runs out of time fails the deploy,
+// and so does the deploy as a whole, whichever stage it is in
+type Timeouts struct {
+	Deploy int            `yaml:"deploy"` // Minutes, defaults to 60
+	Stages map[string]int `yaml:"stages"` // Seconds by stage name, overriding the built-in defaults
+}
+
+func (t Timeouts) DeployDuration() time.Duration {
+	if t.Deploy <= 0 {
+		return 60 * time.Minute
+	}
+	return time.Duration(t.Deploy) * time.Minute
+}
+
+// Argo gives apps in an Argo CD project their own token, so a leaked token only
+// reaches that project. Apps not listed use the default token
+type Argo struct {
+	Projects map[string]ArgoProject `yaml:"projects"`
+}
+
+// ArgoProject authenticates with a token file, or logs in as a user whose password is
+// in a file; either can be a mounted secret that gets rotated
+type ArgoProject struct {
+	Apps         []string `yaml:"apps"`
+	TokenFile    string   `yaml:"token_file,omitempty"`
+	Username     string   `yaml:"username,omitempty"`
+	PasswordFile string   `yaml:"password_file,omitempty"`
+}
+
+// Config holds the settings too structured to live in environment variables
+type Config struct {
+	// Custom stages keyed by app
+	Pipelines map[string][]StageConfig `yaml:"pipelines"`
+	RBAC      RBAC                     `yaml:"rbac"`
+	Approval  Approval                 `yaml:"approval"`
+	Freezes   Freezes                  `yaml:"freezes"`
+	Timeouts  Timeouts                 `yaml:"timeouts"`
+	Argo      Argo                     `yaml:"argo"`
+}
+
+var (
+	once    sync.Once
+	loaded  *Config
+	loadErr error
+)
+
+func Parse(data []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get loads the file at BOT_CONFIG (default config.yaml) the first time it is called.
+// A missing or invalid file is logged and treated as an empty config
+func Get() *Config {
+	once.Do(func() {
+		path := os.Getenv("BOT_CONFIG")
+		if path == "" {
+			path = "config.yaml"
+		}
+		loaded = &Config{}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logging.Errorf("Error reading config %s: %s", path, err)
+				loadErr = fmt.Errorf("reading %s: %w", path, err)
+			}
+			return
+		}
+		c, err := Parse(data)
+		if err != nil {
+			logging.Errorf("Error parsing config %s: %s", path, err)
+			loadErr = fmt.Errorf("parsing %s: %w", path, err)
+			return
+		}
+		loaded = c
+	})
+	return loaded
+}
+
+// Err is why the config could not be loaded, if it couldn't. Get carries on with an
+// empty config, so the bot refuses to start on it and readiness reports it
+func Err() error {
+	Get()
+	return loadErr
+}
@@ -0,0 +1,49 @@
+package dedup
+
+import (
+	"sync"
+	"time"
+)
+
+// Slack retries an event up to three times over about half an hour,
+// so keys are remembered for a little longer than that
+const DefaultTTL = time.Hour
+
+// Cache remembers keys it has seen so events delivered more than once are only handled once
+type Cache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen map[string]time.Time
+}
+
+func New(ttl time.Duration) *Cache {
+	return &Cache{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// First records key and reports whether this is the first time it has been seen within the TTL.
+// An empty key is never treated as a duplicate
+func (c *Cache) First(key string) bool {
+	if key == "" {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, t := range c.seen {
+		if now.Sub(t) > c.ttl {
+			delete(c.seen, k)
+		}
+	}
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = now
+	return true
+}
+
+// Len returns how many keys are currently remembered
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen)
+}
@@ -0,0 +1,42 @@
+package dedup_test
+
+import (
+	"deploy-bot/dedup"
+	"testing"
+	"time"
+)
+
+func TestFirst(t *testing.T) {
+	c := dedup.New(time.Hour)
+
+	tt := []struct {
+		key  string
+		want bool
+	}{
+		{"Ev01", true},
+		{"Ev02", true},
+		{"Ev01", false}, // Slack retry
+		{"Ev01", false},
+		{"", true}, // No event ID to go on
+		{"", true},
+	}
+	for i, v := range tt {
+		t.Run(v.key, func(t *testing.T) {
+			if got := c.First(v.key); got != v.want {
+				t.Errorf("Test %d: First(%s) got %v, want %v", i+1, v.key, got, v.want)
+			}
+		})
+	}
+	if got := c.Len(); got != 2 {
+		t.Errorf("Len() got %d, want 2", got)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := dedup.New(time.Millisecond)
+	c.First("Ev01")
+	time.Sleep(5 * time.Millisecond)
+	if !c.First("Ev01") {
+		t.Errorf("First(Ev01) after TTL got false, want true")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"deploy-bot/audit"
+	"deploy-bot/auth"
+	"deploy-bot/config"
+	"deploy-bot/logging"
+	"deploy-bot/metrics"
+	"deploy-bot/pipeline"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"deploy-bot/tracing"
+	"deploy-bot/util"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type hookWaiter struct {
+	notify  func(msg string)
+	arrived chan struct{}
+	once    sync.Once
+	span    trace.SpanContext // Forwarding the githook is part of the deploy's trace
+}
+
+func (w *hookWaiter) arrive() {
+	w.once.Do(func() { close(w.arrived) })
+}
+
+// How long GitHub gets to hear how a deploy went, once the deploy's own context is done
+const reportTimeout = 30 * time.Second
+
+// runningDeploy is a deploy in progress, which `@bot cancel` stops by cancelling its context
+type runningDeploy struct {
+	record *store.Deploy
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	by     string // Who cancelled it
+}
+
+func (r *runningDeploy) cancelBy(user string) {
+	r.mu.Lock()
+	if r.by == "" {
+		r.by = user
+	}
+	r.mu.Unlock()
+	r.cancel()
+}
+
+func (r *runningDeploy) cancelledBy() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.by
+}
+
+// deployLogger tags log lines with the deploy they belong to. The deploy ID comes from
+// the history, so a resumed deploy logs under the same ID as before the restart
+func deployLogger(record *store.Deploy) *logging.Logger {
+	return logging.With("deploy_id", record.ID, "app", record.App, "env", record.Environment, "requester", record.Requester)
+}
+
+// newState starts the pipeline state for a deploy or plan with the bot's services
+func (b *Bot) newState(ctx context.Context, text, user, env string, notify func(msg string)) *pipeline.State {
+	return &pipeline.State{
+		Ctx:      ctx,
+		Repo:     b.Repo,
+		Registry: b.Registry,
+		GitOps:   b.GitOps,
+		CD:       b.CD,
+		Text:     text,
+		User:     user,
+		Env:      env,
+		Notify:   notify,
+	}
+}
+
+// doDeploy is run by the deploy queue
+func (b *Bot) doDeploy(text string, record *store.Deploy, connInfo slackbot.ConnInfo) {
+	b.runDeploy(text, record, connInfo, "")
+}
+
+// runDeploy runs the app's pipeline for record starting at the named stage, or from
+// the beginning if from is empty, persisting progress and the outcome as it goes
+func (b *Bot) runDeploy(text string, record *store.Deploy, connInfo slackbot.ConnInfo, from string) {
+	if !b.inflight.admit() {
+		// Left queued in the history, so it starts once the bot is back
+		b.Slack.SendMessage(connInfo, fmt.Sprintf("_I'm restarting, deploy #%d will start when I'm back_", record.ID))
+		return
+	}
+	defer b.inflight.done()
+	metrics.RunningDeploys.Inc()
+	defer metrics.RunningDeploys.Dec()
+
+	ctx, cancel := context.WithTimeout(b.ctx, config.Get().Timeouts.DeployDuration())
+	defer cancel()
+	ctx, span := tracing.Tracer().Start(ctx, "deploy", trace.WithAttributes(
+		attribute.Int("deploy.id", record.ID),
+		attribute.String("app", record.App),
+		attribute.String("env", record.Environment),
+		attribute.String("requester", record.Requester),
+	))
+	defer func() {
+		span.SetAttributes(attribute.String("deploy.result", record.Result))
+		var err error
+		if metrics.Outcome(record.Result) != "success" {
+			err = errors.New(record.Result)
+		}
+		tracing.End(span, err)
+	}()
+	// Slack calls for the thread join the trace too
+	connInfo.Span = span.SpanContext()
+	logger := deployLogger(record).With("trace_id", tracing.TraceID(ctx))
+	ctx = logging.NewContext(ctx, logger)
+	rd := &runningDeploy{record: record, cancel: cancel}
+	b.running.Store(record.ID, rd)
+	defer b.running.Delete(record.ID)
+
+	if record.StartedAt.IsZero() {
+		record.StartedAt = time.Now()
+	}
+	record.Result = "running"
+	b.saveDeploy(record)
+
+	// A freeze may have started while the deploy was queued
+	app, env := record.App, record.Environment
+	if f := b.activeFreeze(env); f != nil && record.Override == "" && from == "" {
+		b.Slack.SendMessage(connInfo, frozenMsg(f, env, app, record.Ref))
+		b.failDeploy(record, "frozen")
+		return
+	}
+
+	// Take the deploy lock up front so a deploy can't interleave with a manual lock
+	if l, ok := b.Locks.Acquire(app, env, record.Requester, "deploy in progress", true); !ok {
+		msg := fmt.Sprintf("_%s_", l)
+		b.Slack.SendMessage(connInfo, msg)
+		b.failDeploy(record, "locked")
+		return
+	}
+	defer b.Locks.ReleaseDeploy(app)
+
+	p, err := pipeline.ForApp(app)
+	if err != nil {
+		msg := fmt.Sprintf("_Error in pipeline config for `%s`: %s_", app, err)
+		b.Slack.SendMessage(connInfo, msg)
+		b.failDeploy(record, err.Error())
+		return
+	}
+
+	card := newStatusCard(b.Slack, record, connInfo, p.Names())
+	card.log = logger
+	card.trace = tracing.TraceID(ctx)
+	if from != "" {
+		card.resumeFrom(from)
+	}
+	card.update()
+
+	// The commit stage triggers the githook, which doHook uses to let the sync stage proceed
+	w := &hookWaiter{notify: card.notify, arrived: make(chan struct{}), span: span.SpanContext()}
+	b.hookWaiters.Store(app, w)
+	defer b.hookWaiters.Delete(app)
+	if from != "" { // Resuming after the commit, its githook went with the restart
+		w.arrive()
+	}
+
+	s := b.newState(ctx, text, record.Requester, env, card.notify)
+	s.Hook = w.arrived
+	s.Approve = b.approveDeploy(record, connInfo)
+	// Already known when resuming
+	s.App = app
+	s.Ref = record.Ref
+	s.SHA = record.SHA
+	s.ImageTag = record.ImageTag
+	s.GitopsCommit = record.GitopsCommit
+	p.OnStage = func(stage string) {
+		record.Stage = stage
+		record.SHA = s.SHA
+		record.ImageTag = s.ImageTag
+		record.GitopsCommit = s.GitopsCommit
+		b.saveDeploy(record)
+		card.start(stage)
+	}
+
+	p.AfterStage = func(t pipeline.Timing, err error) {
+		card.setLinks(s)
+		card.finish(t, err)
+		metrics.StageDuration.WithLabelValues(app, t.Stage, strconv.FormatBool(err != nil)).Observe(t.Duration.Seconds())
+		if t.Stage == pipeline.StageWatch && s.Result != "" {
+			metrics.ArgoSyncs.WithLabelValues(app, s.Result).Inc()
+		}
+		if t.Stage == pipeline.StageVerifyImage && err == nil {
+			b.startGitHubDeployment(s, record)
+		}
+
+		e := audit.Entry{Actor: "deploy-bot", Channel: connInfo.Channel, App: app, Env: env, Detail: fmt.Sprintf("deploy #%d", record.ID)}
+		switch {
+		case t.Stage == pipeline.StageCommit && err == nil:
+			e.Action, e.Outcome = "gitops-commit", s.GitopsCommit
+		case t.Stage == pipeline.StageSync:
+			e.Action, e.Outcome = "argo-sync", "requested"
+		case t.Stage == pipeline.StageWatch:
+			e.Action, e.Outcome = "argo-sync", s.Result
+		default:
+			return
+		}
+		if err != nil {
+			e.Outcome = "failed: " + err.Error()
+		}
+		b.auditEvent(e)
+	}
+
+	err = p.RunFrom(s, from)
+	record.SHA = s.SHA
+	record.ImageTag = s.ImageTag
+	record.GitopsCommit = s.GitopsCommit
+	if err != nil && b.ctx.Err() != nil {
+		// Shutting down: leave the record unfinished so the deploy resumes on restart
+		logger.Warnf("Deploy #%d of %s stopped at %s by shutdown", record.ID, app, record.Stage)
+		card.notify(fmt.Sprintf("_I'm restarting, deploy #%d will pick up from `%s` when I'm back_", record.ID, record.Stage))
+		return
+	}
+
+	// The deploy's context may be done by now, GitHub still needs to hear how it went
+	report, cancelReport := context.WithTimeout(tracing.Detach(ctx), reportTimeout)
+	defer cancelReport()
+	s.Ctx = logging.NewContext(report, logger)
+	if err != nil {
+		se := pipeline.AsStageError(err, record.Stage)
+		if by := rd.cancelledBy(); by != "" && errors.Is(se, context.Canceled) {
+			logger.Infof("Deploy #%d of %s cancelled by %s during %s", record.ID, app, by, se.Stage)
+			se.Msg = fmt.Sprintf("_Deploy #%d was cancelled by <@%s> during `%s`_", record.ID, by, se.Stage)
+			card.fail(se)
+			b.setGitHubDeploymentStatus(s, record, "failure", fmt.Sprintf("Cancelled at %s", se.Stage))
+			b.finishRecord(record, fmt.Sprintf("cancelled by <@%s>", by))
+			return
+		}
+		logger.Warnf("Deploy #%d of %s failed: %s", record.ID, app, se)
+		card.fail(se)
+		b.setGitHubDeploymentStatus(s, record, "failure", fmt.Sprintf("Failed at %s", se.Stage))
+		b.failDeploy(record, se.Error())
+		return
+	}
+	logger.Infof("Deploy #%d of %s finished: %s", record.ID, app, s.TimingSummary())
+	card.succeed(s.Result)
+	b.setGitHubDeploymentStatus(s, record, "success", s.Result)
+	b.commentOnPR(s, record)
+	b.finishRecord(record, s.Result)
+}
+
+// doPlan runs the same verification as a deploy but stops before anything is
+// pushed or synced, reporting what the bot would have done instead
+func (b *Bot) doPlan(text, user string, connInfo slackbot.ConnInfo) {
+	valid, msg, app, _ := util.CheckArgsValid(text)
+	if valid != true {
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if !b.authorize(user, app, auth.Viewer, connInfo) {
+		return
+	}
+	p, err := pipeline.ForApp(app)
+	if err != nil {
+		msg := fmt.Sprintf("_Error in pipeline config for `%s`: %s_", app, err)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+
+	notify := func(msg string) {
+		b.Slack.SendMessage(connInfo, msg)
+	}
+	// Bounded like a deploy, so a slow GitHub, ECR or Argo can't leave a plan hanging until shutdown
+	ctx, cancel := context.WithTimeout(b.ctx, config.Get().Timeouts.DeployDuration())
+	defer cancel()
+	s := b.newState(ctx, text, user, util.GetEnvironment(connInfo.Channel), notify)
+	p, skipped := p.WithoutCustom()
+	if len(skipped) > 0 {
+		msg := fmt.Sprintf("_Plan skips custom stages, they only run for real deploys:_ `%s`", strings.Join(skipped, "`, `"))
+		b.Slack.SendMessage(connInfo, msg)
+	}
+	if err := p.Until(pipeline.StageCommit).Run(s); err != nil {
+		if se := pipeline.AsStageError(err, "plan"); se.Msg != "" {
+			b.Slack.SendMessage(connInfo, se.Msg)
+		}
+		return
+	}
+
+	diff := util.DiffLines(s.OldValues, string(s.NewValues))
+	msg = fmt.Sprintf("_Plan: would commit to `%s`:_\n```%s```", s.RepoContent.GetPath(), diff)
+	b.Slack.SendMessage(connInfo, msg)
+
+	modified, msg, err := b.CD.Diff(s.Ctx, s.App)
+	if err != nil {
+		logging.FromContext(s.Ctx).Errorf("Error diffing application in Argocd: %s", err.Error())
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	// Argo can only diff what's been pushed, so this is how things stand today rather than part of the plan
+	if len(modified) == 0 {
+		msg = fmt.Sprintf("_Current drift (not part of the plan): Argocd reports `%s` live state matches the current gitops revision_", s.App)
+	} else {
+		msg = fmt.Sprintf("_Current drift (not part of the plan): Argocd reports these resources already differ from the current gitops revision:_ `%s`", strings.Join(modified, "`, `"))
+	}
+	b.Slack.SendMessage(connInfo, msg)
+	msg = fmt.Sprintf("_Plan complete, nothing was pushed or synced. Run `@%s %s %s` to deploy_", os.Getenv("SLACKBOT_NAME"), s.App, s.Ref)
+	b.Slack.SendMessage(connInfo, msg)
+}
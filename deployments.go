@@ -0,0 +1,52 @@
+package main
+
+import (
+	"deploy-bot/argo"
+	"deploy-bot/logging"
+	"deploy-bot/pipeline"
+	"deploy-bot/store"
+	"fmt"
+	"strconv"
+)
+
+// startGitHubDeployment records the deploy as a GitHub Deployment of its commit once the SHA is known,
+// so the app's repo shows which environment each PR is live on. A resumed deploy keeps the one it had
+func (b *Bot) startGitHubDeployment(s *pipeline.State, record *store.Deploy) {
+	if record.Deployment != 0 || s.SHA == "" {
+		return
+	}
+	desc := fmt.Sprintf("Deploy #%d of %s", record.ID, s.ImageTag)
+	id, err := b.Repo.CreateDeployment(s.Ctx, s.App, s.SHA, s.Env, desc)
+	if err != nil {
+		logging.FromContext(s.Ctx).Errorf("Error creating GitHub deployment for deploy #%d: %s", record.ID, err)
+		return
+	}
+	record.Deployment = id
+	b.setGitHubDeploymentStatus(s, record, "in_progress", desc)
+}
+
+// setGitHubDeploymentStatus is a no-op for deploys that never got a GitHub Deployment
+func (b *Bot) setGitHubDeploymentStatus(s *pipeline.State, record *store.Deploy, state, desc string) {
+	if record.Deployment == 0 {
+		return
+	}
+	err := b.Repo.SetDeploymentStatus(s.Ctx, record.App, record.Deployment, state, desc, record.Thread, argo.AppURL(record.App))
+	if err != nil {
+		logging.FromContext(s.Ctx).Errorf("Error setting GitHub deployment %d of deploy #%d to %s: %s", record.Deployment, record.ID, state, err)
+	}
+}
+
+// commentOnPR tells anyone watching the PR that it has been deployed
+func (b *Bot) commentOnPR(s *pipeline.State, record *store.Deploy) {
+	prNum, err := strconv.Atoi(record.Ref)
+	if err != nil || prNum <= 0 { // Deploying main
+		return
+	}
+	body := fmt.Sprintf("Deployed `%s` to **%s**, requested by %s in Slack.", s.ImageTag, record.Environment, b.Slack.UserName(record.Requester))
+	if record.Thread != "" {
+		body += fmt.Sprintf("\n\n[Deploy #%d thread](%s)", record.ID, record.Thread)
+	}
+	if err := b.Repo.CommentOnPR(s.Ctx, record.App, prNum, body); err != nil {
+		logging.FromContext(s.Ctx).Errorf("Error commenting on %s PR #%d for deploy #%d: %s", record.App, prNum, record.ID, err)
+	}
+}
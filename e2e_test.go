@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"deploy-bot/auth"
+	"deploy-bot/config"
+	"deploy-bot/internal/fakes"
+	"deploy-bot/metrics"
+	"deploy-bot/pipeline"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/slack-go/slack/slackevents"
+)
+
+const (
+	testChannel = "C1"
+	testTimeout = 5 * time.Second
+)
+
+type testBot struct {
+	*Bot
+	repo     *fakes.Repo
+	registry *fakes.Registry
+	gitops   *fakes.GitOps
+	cd       *fakes.CD
+	slack    *fakes.Slack
+}
+
+// newTestBot wires the bot to fakes holding the `time` app, with PR 18 built and
+// pushed to ECR, U1 allowed to deploy and U2 only allowed to look
+func newTestBot(t *testing.T) *testBot {
+	t.Setenv("SUPPORTED_APPS", "time,sales")
+	t.Setenv("SLACKBOT_NAME", "deploy-bot")
+	t.Setenv("GITOPS_REPO", "gitops")
+	t.Setenv("BOT_CONFIG", filepath.Join(t.TempDir(), "none.yaml"))
+
+	history, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("store.Open() error: %s", err)
+	}
+	t.Cleanup(func() { history.Close() })
+	authz, err := auth.New([]config.Grant{
+		{Role: "deployer", Users: []string{"U1"}},
+		{Role: "viewer", Users: []string{"U2"}},
+	}, func(string) ([]string, error) { return nil, nil })
+	if err != nil {
+		t.Fatalf("auth.New() error: %s", err)
+	}
+
+	tb := &testBot{
+		repo:     fakes.NewRepo(),
+		registry: fakes.NewRegistry(),
+		gitops:   fakes.NewGitOps(),
+		cd:       fakes.NewCD(),
+		slack:    fakes.NewSlack(),
+	}
+	tb.Bot = NewBot(Services{
+		Repo:     tb.repo,
+		Registry: tb.registry,
+		GitOps:   tb.gitops,
+		CD:       tb.cd,
+		Slack:    tb.slack,
+	}, history, authz)
+	t.Cleanup(tb.stop)
+
+	tb.repo.AddPR("time", 18, "feature", "abcdef0123456789")
+	tb.registry.Push("time", "feature-abcdef0")
+	tb.repo.SetHead("time", "main", "0123456789abcdef")
+	tb.gitops.SetValues("time", "image:\n  repository: time\n  tag: main-1111111\n")
+
+	// Pushing to the gitops repo sends the githook back to the bot, as GitHub would
+	tb.gitops.OnPush = func(app, sha string) {
+		body := fmt.Sprintf(`{"head_commit":{"id":%q,"modified":["%s/values.yaml"]},"pusher":{"name":"deploy-bot"}}`, sha, app)
+		w := httptest.NewRecorder()
+		tb.gitHook(w, httptest.NewRequest(http.MethodPost, "/githook", strings.NewReader(body)))
+	}
+	return tb
+}
+
+// mention sends an app mention from user as Slack would, returning the thread it starts
+func (tb *testBot) mention(user, text, ts string) slackbot.ConnInfo {
+	return tb.mentionIn(testChannel, user, text, ts)
+}
+
+// mentionIn is mention in another channel, and so possibly another environment
+func (tb *testBot) mentionIn(channel, user, text, ts string) slackbot.ConnInfo {
+	e := &slackevents.AppMentionEvent{User: user, Text: "<@UBOT> " + text, Channel: channel, TimeStamp: ts}
+	connInfo := slackbot.ConnInfo{Channel: channel, Timestamp: ts}
+	tb.doEvent(e, connInfo)
+	return connInfo
+}
+
+// waitForDeploy waits for deploy id to finish, returning its record
+func (tb *testBot) waitForDeploy(t *testing.T, id int) *store.Deploy {
+	return tb.waitForStage(t, id, store.StageDone)
+}
+
+// waitForStage waits for deploy id to reach stage, or to get past queued when stage is empty
+func (tb *testBot) waitForStage(t *testing.T, id int, stage string) *store.Deploy {
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		d, err := tb.History.Get(id)
+		if err == nil && (d.Stage == stage || stage == "" && d.Stage != store.StageQueued) {
+			return d
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Deploy #%d did not reach %q within %s", id, stage, testTimeout)
+	return nil
+}
+
+// inflightDone waits for everything the bot is working on to finish
+func (tb *testBot) inflightDone(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		tb.inflight.mu.Lock()
+		n := tb.inflight.n
+		tb.inflight.mu.Unlock()
+		if n == 0 {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestDeployPR(t *testing.T) {
+	tb := newTestBot(t)
+	successes := testutil.ToFloat64(metrics.Deploys.WithLabelValues("time", "staging", "success"))
+	syncs := testutil.ToFloat64(metrics.ArgoSyncs.WithLabelValues("time", "Synced"))
+	thread := tb.mention("U1", "time 18", "100.000001")
+
+	if !tb.slack.WaitFor(thread.Channel, thread.Timestamp, "Synced", testTimeout) {
+		t.Fatalf("No Synced message, thread: %q", tb.slack.Thread(thread.Channel, thread.Timestamp))
+	}
+	d := tb.waitForDeploy(t, 1)
+
+	commits := tb.gitops.Commits()
+	tag, _ := tb.gitops.CurrentImageTag(context.Background(), "time")
+	deployments := tb.repo.Deployments()
+	tt := []struct {
+		desc string
+		got  interface{}
+		want interface{}
+	}{
+		{"Result", d.Result, "Synced"},
+		{"Image tag", d.ImageTag, "feature-abcdef0"},
+		{"Values tag", tag, "feature-abcdef0"},
+		{"Gitops commit", d.GitopsCommit, commits[len(commits)-1]},
+		{"Githooks forwarded", tb.cd.Gitshots, 1},
+		{"GitHub deployments", len(deployments), 1},
+		{"GitHub deployment statuses", strings.Join(deployments[0].Statuses, ","), "in_progress,success"},
+		{"PR comments", len(tb.repo.Comments("time", 18)), 1},
+		{"Locked after deploy", tb.Locks.Get("time") != nil, false},
+		{"Successful deploys counted", testutil.ToFloat64(metrics.Deploys.WithLabelValues("time", "staging", "success")) - successes, 1.0},
+		{"Argo syncs counted", testutil.ToFloat64(metrics.ArgoSyncs.WithLabelValues("time", "Synced")) - syncs, 1.0},
+		{"Running deploys", testutil.ToFloat64(metrics.RunningDeploys), 0.0},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			if v.got != v.want {
+				t.Errorf("Test %d: %s got %v, want %v", i+1, v.desc, v.got, v.want)
+			}
+		})
+	}
+}
+
+// Both environments' deploys of an app write its one values file and wait on its githook,
+// so they have to take turns
+func TestDeployTwoEnvironments(t *testing.T) {
+	tb := newTestBot(t)
+	staging := tb.mention("U1", "time 18", "150.000001")
+	t.Setenv("DEFAULT_ENVIRONMENT", "qa")
+	tb.registry.Push("time", "main-0123456")
+	qa := tb.mention("U1", "time main", "150.000002")
+
+	for i, thread := range []slackbot.ConnInfo{staging, qa} {
+		if !tb.slack.WaitFor(thread.Channel, thread.Timestamp, "Synced", testTimeout) {
+			t.Errorf("Test %d: got thread %q, want Synced", i+1, tb.slack.Thread(thread.Channel, thread.Timestamp))
+		}
+	}
+	first, second := tb.waitForDeploy(t, 1), tb.waitForDeploy(t, 2)
+	if first.Environment != "staging" || second.Environment != "qa" {
+		t.Fatalf("Deploys went to %s and %s, want staging and qa", first.Environment, second.Environment)
+	}
+	if second.StartedAt.Before(first.FinishedAt) {
+		t.Errorf("Deploy #2 started at %s, before deploy #1 finished at %s", second.StartedAt, first.FinishedAt)
+	}
+	if tb.cd.Gitshots != 2 {
+		t.Errorf("Forwarded %d githooks, want 2", tb.cd.Gitshots)
+	}
+}
+
+// Deploys the last run left unfinished pick up again in their own threads: one that was
+// watching Argo goes back to watching, one in a stage since renamed syncs the commit it
+// landed, and one whose commit never landed starts over
+func TestResumeDeploys(t *testing.T) {
+	tb := newTestBot(t)
+	tb.gitops.SetValues("time", "image:\n  repository: time\n  tag: feature-abcdef0\n")
+	tb.registry.Push("time", "main-0123456")
+	watching := &store.Deploy{
+		Requester: "U1", App: "time", Environment: "staging", Ref: "18",
+		SHA: "abcdef0123456789", ImageTag: "feature-abcdef0", GitopsCommit: "fedcba9876543210",
+		Stage: pipeline.StageWatch, Result: "running", Channel: testChannel, ThreadTS: "175.000001",
+	}
+	renamed := &store.Deploy{
+		Requester: "U1", App: "time", Environment: "staging", Ref: "18",
+		SHA: "abcdef0123456789", ImageTag: "feature-abcdef0", GitopsCommit: "fedcba9876543210",
+		Stage: "pushing", Result: "running", Channel: testChannel, ThreadTS: "175.000002",
+	}
+	committing := &store.Deploy{
+		Requester: "U1", App: "time", Environment: "staging", Ref: "main",
+		SHA: "0123456789abcdef", ImageTag: "main-0123456",
+		Stage: pipeline.StageCommit, Result: "running", Channel: testChannel, ThreadTS: "175.000003",
+	}
+	for _, d := range []*store.Deploy{watching, renamed, committing} {
+		if err := tb.History.Save(d); err != nil {
+			t.Fatalf("Save() error: %s", err)
+		}
+	}
+	commits := len(tb.gitops.Commits())
+	tb.resumeDeploys()
+
+	tt := []struct {
+		desc   string
+		record *store.Deploy
+		from   string
+	}{
+		{"Watching", watching, pipeline.StageWatch},
+		{"Stage renamed, commit landed", renamed, "pushing"},
+		{"Commit not landed", committing, pipeline.StageCommit},
+	}
+	for i, c := range tt {
+		t.Run(c.desc, func(t *testing.T) {
+			resumed := fmt.Sprintf("resuming deploy #%d from the `%s` stage", c.record.ID, c.from)
+			for _, want := range []string{resumed, "Synced"} {
+				if !tb.slack.WaitFor(testChannel, c.record.ThreadTS, want, testTimeout) {
+					t.Errorf("Test %d: got thread %q, want %q", i+1, tb.slack.Thread(testChannel, c.record.ThreadTS), want)
+				}
+			}
+			if d := tb.waitForDeploy(t, c.record.ID); d.Result != "Synced" {
+				t.Errorf("Test %d: resumed deploy got result %q, want Synced", i+1, d.Result)
+			}
+		})
+	}
+
+	tag, _ := tb.gitops.CurrentImageTag(context.Background(), "time")
+	if got := len(tb.gitops.Commits()) - commits; got != 1 {
+		t.Errorf("Resumed deploys made %d gitops commits, want 1", got)
+	}
+	if tag != "main-0123456" {
+		t.Errorf("Values tag got %s, want main-0123456", tag)
+	}
+	if tb.cd.Syncs != 2 {
+		t.Errorf("Resumed deploys requested %d Argo syncs, want 2", tb.cd.Syncs)
+	}
+}
+
+func TestDeployFailures(t *testing.T) {
+	tt := []struct {
+		desc       string
+		user       string
+		text       string
+		setup      func(tb *testBot)
+		wantMsg    string
+		wantResult string // Empty when no deploy should be recorded
+	}{
+		{"Viewer can't deploy", "U2", "time 18", nil, "you need the deployer role", ""},
+		{"Unknown app", "U1", "t1me 18", nil, "I do not recognize t1me", ""},
+		{"Image not in ECR", "U1", "time main", nil, "does not exist in ECR", "failed: verify-image"},
+		{"Unknown PR", "U1", "time 19", nil, "has no PR 19", "failed: resolve-ref"},
+		{"Sync fails", "U1", "time 18", func(tb *testBot) { tb.cd.Result = "Sync timeout" }, "failed at watch", "failed: watch: Sync timeout"},
+		{"Locked", "U1", "time 18", func(tb *testBot) { tb.Locks.Acquire("time", "staging", "U3", "testing", false) }, "is locked by <@U3>", "failed: locked"},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			tb := newTestBot(t)
+			if v.setup != nil {
+				v.setup(tb)
+			}
+			thread := tb.mention(v.user, v.text, "200.000001")
+			if !tb.slack.WaitFor(thread.Channel, thread.Timestamp, v.wantMsg, testTimeout) {
+				t.Fatalf("Test %d: %s got thread %q, want a message containing %q", i+1, v.desc, tb.slack.Thread(thread.Channel, thread.Timestamp), v.wantMsg)
+			}
+			if v.wantResult == "" {
+				if d, err := tb.History.Get(1); err == nil {
+					t.Errorf("Test %d: %s recorded deploy %s, want none", i+1, v.desc, d)
+				}
+				return
+			}
+			if d := tb.waitForDeploy(t, 1); !strings.HasPrefix(d.Result, v.wantResult) {
+				t.Errorf("Test %d: %s got result %q, want %q", i+1, v.desc, d.Result, v.wantResult)
+			}
+		})
+	}
+}
+
+// Cancelling a queued deploy takes a role in the deploy's environment, whichever channel it's typed in
+func TestCancelQueuedDeploy(t *testing.T) {
+	tt := []struct {
+		desc       string
+		user       string
+		wantMsg    string
+		wantResult string
+	}{
+		{"Staging admin can't", "U4", "you need the deployer role for `time` in production", ""},
+		{"Production admin can", "U5", "Deploy #2 of `time` main cancelled", "cancelled by <@U5>"},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			tb := newTestBot(t)
+			t.Setenv("PROTECTED_CHANNEL", testChannel)
+			authz, err := auth.New([]config.Grant{
+				{Role: "deployer", Users: []string{"U1"}},
+				{Role: "admin", Users: []string{"U4"}, Environments: []string{"staging"}},
+				{Role: "admin", Users: []string{"U5"}, Environments: []string{"production"}},
+			}, func(string) ([]string, error) { return nil, nil })
+			if err != nil {
+				t.Fatalf("auth.New() error: %s", err)
+			}
+			tb.Authz = authz
+			tb.registry.Push("time", "main-0123456")
+			tb.mention("U1", "time 18", "350.000001")
+			tb.waitForStage(t, 1, pipeline.StageApprove) // Where it waits, so #2 stays queued
+			tb.mention("U1", "time main", "350.000002")
+
+			thread := tb.mentionIn("C2", v.user, "cancel 2", "350.000003")
+			if !tb.slack.WaitFor(thread.Channel, thread.Timestamp, v.wantMsg, testTimeout) {
+				t.Fatalf("Test %d: %s got thread %q, want a message containing %q", i+1, v.desc, tb.slack.Thread(thread.Channel, thread.Timestamp), v.wantMsg)
+			}
+			d, err := tb.History.Get(2)
+			if err != nil {
+				t.Fatalf("Test %d: Get(2) error: %s", i+1, err)
+			}
+			if v.wantResult == "" && d.Stage != store.StageQueued {
+				t.Errorf("Test %d: %s moved deploy #2 to %s, want it still queued", i+1, v.desc, d.Stage)
+			}
+			if v.wantResult != "" && d.Result != v.wantResult {
+				t.Errorf("Test %d: %s got result %q, want %q", i+1, v.desc, d.Result, v.wantResult)
+			}
+		})
+	}
+}
+
+func TestCancelRunningDeploy(t *testing.T) {
+	tt := []struct {
+		desc       string
+		user       string
+		wantMsg    string
+		wantResult string
+	}{
+		{"Requester cancels", "U1", "Cancelling deploy #1", "cancelled by <@U1>"},
+		{"Someone else can't", "U3", "deploy #1 belongs to <@U1>", ""},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			tb := newTestBot(t)
+			authz, err := auth.New([]config.Grant{{Role: "deployer", Users: []string{"U1", "U3"}}}, func(string) ([]string, error) { return nil, nil })
+			if err != nil {
+				t.Fatalf("auth.New() error: %s", err)
+			}
+			tb.Authz = authz
+			tb.cd.Hang = true
+			tb.mention("U1", "time 18", "300.000001")
+
+			tb.waitForStage(t, 1, pipeline.StageWatch) // Where it hangs
+
+			thread := tb.mention(v.user, "cancel 1", "300.000002")
+			if !tb.slack.WaitFor(thread.Channel, thread.Timestamp, v.wantMsg, testTimeout) {
+				t.Fatalf("Test %d: %s got thread %q, want a message containing %q", i+1, v.desc, tb.slack.Thread(thread.Channel, thread.Timestamp), v.wantMsg)
+			}
+			if v.wantResult == "" {
+				if _, running := tb.running.Load(1); !running {
+					t.Errorf("Test %d: %s stopped deploy #1", i+1, v.desc)
+				}
+				tb.running.Range(func(_, rd interface{}) bool { rd.(*runningDeploy).cancel(); return true })
+				tb.waitForDeploy(t, 1)
+				return
+			}
+			if d := tb.waitForDeploy(t, 1); d.Result != v.wantResult {
+				t.Errorf("Test %d: %s got result %q, want %q", i+1, v.desc, d.Result, v.wantResult)
+			}
+			deployments := tb.repo.Deployments()
+			if got := strings.Join(deployments[0].Statuses, ","); got != "in_progress,failure" {
+				t.Errorf("Test %d: %s got GitHub deployment statuses %s, want in_progress,failure", i+1, v.desc, got)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tt := []struct {
+		desc      string
+		hang      bool
+		githooks  bool // Send githooks once the drain has finished
+		wantStage string
+		wantMsg   string
+	}{
+		{"Deploy finishes within grace", false, false, store.StageDone, "Synced"},
+		{"Deploy abandoned", true, false, pipeline.StageWatch, "I'm restarting, deploy #1 will pick up from `watch`"},
+		{"Githooks after the drain", false, true, store.StageDone, "Synced"},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			tb := newTestBot(t)
+			tb.cd.Hang = v.hang
+			thread := tb.mention("U1", "time 18", "400.000001")
+			if v.hang {
+				tb.waitForStage(t, 1, pipeline.StageWatch)
+			} else {
+				tb.waitForStage(t, 1, "")
+			}
+
+			tb.Shutdown(100 * time.Millisecond)
+			if !tb.slack.WaitFor(thread.Channel, thread.Timestamp, v.wantMsg, testTimeout) {
+				t.Errorf("Test %d: %s got thread %q, want a message containing %q", i+1, v.desc, tb.slack.Thread(thread.Channel, thread.Timestamp), v.wantMsg)
+			}
+			if d, err := tb.History.Get(1); err != nil || d.Stage != v.wantStage {
+				t.Errorf("Test %d: %s got deploy %v, %v, want stage %s", i+1, v.desc, d, err, v.wantStage)
+			}
+
+			// Mentions after shutdown has begun are turned away
+			e := &slackevents.AppMentionEvent{User: "U1", Text: "<@UBOT> time 18", Channel: testChannel, TimeStamp: "400.000002"}
+			tb.dispatchEvent(slackevents.EventsAPIEvent{
+				Data:       &slackevents.EventsAPICallbackEvent{EventID: "Ev400"},
+				InnerEvent: slackevents.EventsAPIInnerEvent{Data: e},
+			}, 0, "")
+			if !tb.slack.WaitFor(testChannel, "400.000002", "I'm restarting, please retry shortly", testTimeout) {
+				t.Errorf("Test %d: %s got thread %q for a mention while draining", i+1, v.desc, tb.slack.Thread(testChannel, "400.000002"))
+			}
+
+			if v.githooks {
+				// Still forwarded, and each one finishing must leave the closed idle channel alone
+				gitshots := tb.cd.Gitshots
+				for n := 0; n < 2; n++ {
+					tb.gitops.OnPush("time", "fedcba9876543210")
+				}
+				if !tb.inflightDone(2 * testTimeout) {
+					t.Errorf("Test %d: %s still has work in flight", i+1, v.desc)
+				}
+				if got := tb.cd.Gitshots - gitshots; got != 2 {
+					t.Errorf("Test %d: %s forwarded %d githooks, want 2", i+1, v.desc, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package freeze
+
+import (
+	"deploy-bot/config"
+	"deploy-bot/store"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts accepted for freeze start and end times, in the configured timezone.
+// A bare date means midnight at the start of that day
+var layouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// Windows expands the recurring windows in cfg into the freezes they cause between from and to
+func Windows(cfg config.Freezes, from, to time.Time) ([]store.Freeze, error) {
+	loc := cfg.Location()
+	var freezes []store.Freeze
+	for _, w := range cfg.Windows {
+		days := make(map[time.Weekday]bool)
+		for _, d := range w.Days {
+			day, err := parseWeekday(d)
+			if err != nil {
+				return nil, fmt.Errorf("freeze window %q: %s", w.Name, err)
+			}
+			days[day] = true
+		}
+		startH, startM, err := parseClock(w.Start, "00:00")
+		if err != nil {
+			return nil, fmt.Errorf("freeze window %q: %s", w.Name, err)
+		}
+		endH, endM, err := parseClock(w.End, "24:00")
+		if err != nil {
+			return nil, fmt.Errorf("freeze window %q: %s", w.Name, err)
+		}
+		envs := w.Environments
+		if len(envs) == 0 {
+			envs = []string{""}
+		}
+
+		// Start the day before so windows running over midnight are caught
+		f := from.In(loc)
+		day := time.Date(f.Year(), f.Month(), f.Day()-1, 0, 0, 0, 0, loc)
+		for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+			if !days[day.Weekday()] {
+				continue
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), startH, startM, 0, 0, loc)
+			end := time.Date(day.Year(), day.Month(), day.Day(), endH, endM, 0, 0, loc)
+			if !end.After(start) {
+				end = end.AddDate(0, 0, 1)
+			}
+			if !end.After(from) || !start.Before(to) {
+				continue
+			}
+			for _, env := range envs {
+				freezes = append(freezes, store.Freeze{Name: w.Name, Env: env, Start: start, End: end})
+			}
+		}
+	}
+	return freezes, nil
+}
+
+// Validate checks the timezone and every window in cfg can be read, and that each window
+// has days and only names environments in envs, so a typo is caught at startup rather
+// than leaving a window that never applies
+func Validate(cfg config.Freezes, envs []string) error {
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return fmt.Errorf("freeze timezone %q: %s", cfg.Timezone, err)
+	}
+	for _, w := range cfg.Windows {
+		if len(w.Days) == 0 {
+			return fmt.Errorf("freeze window %q has no days", w.Name)
+		}
+		for _, env := range w.Environments {
+			if !contains(envs, env) {
+				return fmt.Errorf("freeze window %q: unknown environment %q, deploys go to %s", w.Name, env, strings.Join(envs, " or "))
+			}
+		}
+	}
+	now := time.Now()
+	_, err := Windows(cfg, now, now)
+	return err
+}
+
+// Active returns the first of freezes covering env at now, or nil
+func Active(freezes []store.Freeze, env string, now time.Time) *store.Freeze {
+	for i, f := range freezes {
+		if (f.Env == "" || f.Env == env) && f.Active(now) {
+			return &freezes[i]
+		}
+	}
+	return nil
+}
+
+// Parse reads the arguments to `freeze <env> [from <time>] until <time> [reason]`
+func Parse(args []string, loc *time.Location, now time.Time) (*store.Freeze, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("not enough arguments")
+	}
+	f := &store.Freeze{Env: args[0], Start: now}
+	rest := args[1:]
+	if rest[0] == "from" {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("not enough arguments")
+		}
+		start, err := parseTime(rest[1], loc)
+		if err != nil {
+			return nil, err
+		}
+		f.Start = start
+		rest = rest[2:]
+	}
+	if rest[0] != "until" {
+		return nil, fmt.Errorf("expected `until`, got `%s`", rest[0])
+	}
+	end, err := parseTime(rest[1], loc)
+	if err != nil {
+		return nil, err
+	}
+	if !end.After(f.Start) || !end.After(now) {
+		return nil, fmt.Errorf("the freeze would be over before it started")
+	}
+	f.End = end
+	f.Reason = strings.Trim(strings.Join(rest[2:], " "), "\"“”")
+	return f, nil
+}
+
+func parseTime(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't read `%s` as a time, try 2026-11-02 or 2026-11-02T15:00", s)
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), s) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q", s)
+}
+
+func parseClock(s, def string) (int, int, error) {
+	if s == "" {
+		s = def
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("can't read %q as HH:MM", s)
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, 0, fmt.Errorf("can't read %q as HH:MM", s)
+	}
+	return h, m, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
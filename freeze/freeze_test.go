@@ -0,0 +1,108 @@
+package freeze_test
+
+import (
+	"deploy-bot/config"
+	"deploy-bot/freeze"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWindows(t *testing.T) {
+	cfg := config.Freezes{
+		Timezone: "UTC",
+		Windows: []config.FreezeWindow{
+			{Name: "Friday afternoon", Environments: []string{"production"}, Days: []string{"friday"}, Start: "15:00"},
+			{Name: "Weekend", Days: []string{"saturday", "sunday"}},
+			{Name: "Overnight", Environments: []string{"staging"}, Days: []string{"monday"}, Start: "22:00", End: "06:00"},
+		},
+	}
+	// 2026-10-16 is a Friday
+	from := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	freezes, err := freeze.Windows(cfg, from, from.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatalf("Windows() error: %s", err)
+	}
+
+	tt := []struct {
+		desc string
+		env  string
+		at   time.Time
+		want string
+	}{
+		{"Friday morning", "production", time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC), ""},
+		{"Friday afternoon", "production", time.Date(2026, 10, 16, 16, 0, 0, 0, time.UTC), "Friday afternoon"},
+		{"Friday afternoon in staging", "staging", time.Date(2026, 10, 16, 16, 0, 0, 0, time.UTC), ""},
+		{"Saturday in any environment", "staging", time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC), "Weekend"},
+		{"Monday night", "staging", time.Date(2026, 10, 19, 23, 0, 0, 0, time.UTC), "Overnight"},
+		{"Tuesday early morning", "staging", time.Date(2026, 10, 20, 5, 59, 0, 0, time.UTC), "Overnight"},
+		{"Tuesday morning", "staging", time.Date(2026, 10, 20, 6, 0, 0, 0, time.UTC), ""},
+	}
+	for i, w := range tt {
+		t.Run(w.desc, func(t *testing.T) {
+			got := ""
+			if f := freeze.Active(freezes, w.env, w.at); f != nil {
+				got = f.Name
+			}
+			if got != w.want {
+				t.Errorf("Test %d: Active(%s,%s) got %q, want %q", i+1, w.env, w.at, got, w.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tt := []struct {
+		desc   string
+		args   string
+		err    bool
+		start  time.Time
+		end    time.Time
+		reason string
+	}{
+		{"Until a date", `production until 2026-11-02 "quarter close"`, false, now, time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC), "quarter close"},
+		{"From and until", "staging from 2026-10-20T09:00 until 2026-10-20T17:00", false, time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC), time.Date(2026, 10, 20, 17, 0, 0, 0, time.UTC), ""},
+		{"Already over", "production until 2026-10-01", true, time.Time{}, time.Time{}, ""},
+		{"Bad date", "production until tomorrow", true, time.Time{}, time.Time{}, ""},
+		{"Missing until", "production 2026-11-02", true, time.Time{}, time.Time{}, ""},
+	}
+	for i, p := range tt {
+		t.Run(p.desc, func(t *testing.T) {
+			f, err := freeze.Parse(strings.Split(p.args, " "), time.UTC, now)
+			if (err != nil) != p.err {
+				t.Fatalf("Test %d: Parse(%s) got error %v, want error %v", i+1, p.args, err, p.err)
+			}
+			if err != nil {
+				return
+			}
+			if !f.Start.Equal(p.start) || !f.End.Equal(p.end) || f.Reason != p.reason {
+				t.Errorf("Test %d: Parse(%s) got %s → %s %q, want %s → %s %q", i+1, p.args, f.Start, f.End, f.Reason, p.start, p.end, p.reason)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tt := []struct {
+		desc    string
+		cfg     config.Freezes
+		wantErr string
+	}{
+		{"Valid", config.Freezes{Timezone: "Europe/London", Windows: []config.FreezeWindow{{Name: "Weekend", Days: []string{"saturday", "sunday"}}}}, ""},
+		{"Misspelled day", config.Freezes{Windows: []config.FreezeWindow{{Name: "Weekend", Days: []string{"saturady"}}}}, `unknown day "saturady"`},
+		{"Bad time", config.Freezes{Windows: []config.FreezeWindow{{Name: "Friday", Days: []string{"friday"}, Start: "3pm"}}}, `can't read "3pm"`},
+		{"Unknown timezone", config.Freezes{Timezone: "Mars/Olympus"}, "Mars/Olympus"},
+		{"No days", config.Freezes{Windows: []config.FreezeWindow{{Name: "Release week", Start: "09:00"}}}, "has no days"},
+		{"Known environment", config.Freezes{Windows: []config.FreezeWindow{{Name: "Weekend", Days: []string{"sunday"}, Environments: []string{"production"}}}}, ""},
+		{"Unknown environment", config.Freezes{Windows: []config.FreezeWindow{{Name: "Weekend", Days: []string{"sunday"}, Environments: []string{"prod"}}}}, `unknown environment "prod"`},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			err := freeze.Validate(v.cfg, []string{"production", "staging"})
+			if v.wantErr == "" && err != nil || v.wantErr != "" && (err == nil || !strings.Contains(err.Error(), v.wantErr)) {
+				t.Errorf("Test %d: Validate() got error %v, want %q", i+1, err, v.wantErr)
+			}
+		})
+	}
+}
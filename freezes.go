@@ -0,0 +1,178 @@
+package main
+
+import (
+	"deploy-bot/audit"
+	"deploy-bot/auth"
+	"deploy-bot/config"
+	"deploy-bot/freeze"
+	"deploy-bot/logging"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far ahead `@bot freezes` looks for recurring windows
+const freezeLookahead = 7 * 24 * time.Hour
+
+// listFreezes returns the stored freezes that haven't ended, plus the recurring
+// windows from config between now and until, ordered by start
+func (b *Bot) listFreezes(now, until time.Time) ([]store.Freeze, error) {
+	stored, err := b.History.Freezes(now)
+	if err != nil {
+		return nil, err
+	}
+	windows, err := freeze.Windows(config.Get().Freezes, now, until)
+	if err != nil {
+		return nil, err
+	}
+	freezes := append(stored, windows...)
+	sort.Slice(freezes, func(i, j int) bool { return freezes[i].Start.Before(freezes[j].Start) })
+	return freezes, nil
+}
+
+// activeFreeze returns the freeze currently blocking deploys to env, or nil. Stored freezes
+// and recurring windows are checked separately so one failing can't lift the other, and
+// freezes that can't be checked block the deploy until an admin overrides it
+func (b *Bot) activeFreeze(env string) *store.Freeze {
+	now := time.Now()
+	stored, err := b.History.Freezes(now)
+	if err != nil {
+		logging.Errorf("Error reading freezes: %s", err)
+		return unknownFreeze(env, now)
+	}
+	if f := freeze.Active(stored, env, now); f != nil {
+		return f
+	}
+	windows, err := freeze.Windows(config.Get().Freezes, now, now.Add(time.Minute))
+	if err != nil {
+		logging.Errorf("Error reading freeze windows: %s", err)
+		return unknownFreeze(env, now)
+	}
+	return freeze.Active(windows, env, now)
+}
+
+// unknownFreeze stands in for freezes that couldn't be checked, failing closed
+func unknownFreeze(env string, now time.Time) *store.Freeze {
+	return &store.Freeze{Env: env, Name: "freezes could not be checked", Start: now, End: now.Add(time.Minute)}
+}
+
+func frozenMsg(f *store.Freeze, env, app, ref string) string {
+	return fmt.Sprintf("_🧊 Deploys to %s are frozen: %s. An admin can `@%s override %s %s <reason>`_",
+		env, f, os.Getenv("SLACKBOT_NAME"), app, ref)
+}
+
+// doFreeze handles `@bot freeze <env> [from <time>] until <time> [reason]`
+func (b *Bot) doFreeze(text, user string, connInfo slackbot.ConnInfo) {
+	args := strings.Split(text, " ")
+	cfg := config.Get().Freezes
+	f, err := freeze.Parse(args[1:], cfg.Location(), time.Now())
+	if err != nil {
+		msg := fmt.Sprintf("_Error: %s. Usage: @%s freeze <env> [from <time>] until <time> [reason]_", err, os.Getenv("SLACKBOT_NAME"))
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if !b.can(user, "", f.Env, auth.Admin) {
+		msg := fmt.Sprintf("_あなたはふさわしくない, translation: you need the admin role for %s_", f.Env)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	f.By = user
+	if err := b.History.SaveFreeze(f); err != nil {
+		msg := fmt.Sprintf("_Error saving freeze: %s_", err)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	logging.Infof("Freeze #%d created by %s: %s", f.ID, user, f)
+	b.auditEvent(audit.Entry{Actor: user, Action: "freeze", Channel: connInfo.Channel, Env: f.Env, Outcome: "created", Detail: f.String()})
+	msg := fmt.Sprintf("_🧊 Freeze #%d: %s_", f.ID, f)
+	b.Slack.SendMessage(connInfo, msg)
+}
+
+// doUnfreeze handles `@bot unfreeze <id>`
+func (b *Bot) doUnfreeze(text, user string, connInfo slackbot.ConnInfo) {
+	args := strings.Split(text, " ")
+	id, err := strconv.Atoi(strings.TrimPrefix(args[len(args)-1], "#"))
+	if len(args) != 2 || err != nil {
+		msg := fmt.Sprintf("_Usage: @%s unfreeze <id>_", os.Getenv("SLACKBOT_NAME"))
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	freezes, err := b.History.Freezes(time.Now())
+	if err != nil {
+		msg := fmt.Sprintf("_Error reading freezes: %s_", err)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	var f *store.Freeze
+	for i := range freezes {
+		if freezes[i].ID == id {
+			f = &freezes[i]
+		}
+	}
+	if f == nil {
+		msg := fmt.Sprintf("_There is no freeze #%d, recurring windows can only be changed in config_", id)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if !b.can(user, "", f.Env, auth.Admin) {
+		msg := fmt.Sprintf("_あなたはふさわしくない, translation: you need the admin role for %s_", f.Env)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if err := b.History.DeleteFreeze(id); err != nil {
+		msg := fmt.Sprintf("_Error deleting freeze: %s_", err)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	logging.Infof("Freeze #%d lifted by %s: %s", f.ID, user, f)
+	b.auditEvent(audit.Entry{Actor: user, Action: "unfreeze", Channel: connInfo.Channel, Env: f.Env, Outcome: "lifted", Detail: f.String()})
+	msg := fmt.Sprintf("_Freeze #%d lifted_", id)
+	b.Slack.SendMessage(connInfo, msg)
+}
+
+// doFreezes handles `@bot freezes`, listing active and upcoming freezes
+func (b *Bot) doFreezes(user string, connInfo slackbot.ConnInfo) {
+	if !b.authorize(user, "", auth.Viewer, connInfo) {
+		return
+	}
+	now := time.Now()
+	freezes, err := b.listFreezes(now, now.Add(freezeLookahead))
+	if err != nil {
+		msg := fmt.Sprintf("_Error reading freezes: %s_", err)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if len(freezes) == 0 {
+		b.Slack.SendMessage(connInfo, "_No freezes in the next 7 days_")
+		return
+	}
+	lines := make([]string, len(freezes))
+	for i, f := range freezes {
+		line := f.String()
+		if f.ID != 0 {
+			line = fmt.Sprintf("#%d %s", f.ID, line)
+		}
+		if f.Active(now) {
+			line = "🧊 " + line + " *[active]*"
+		}
+		lines[i] = line
+	}
+	b.Slack.SendMessage(connInfo, strings.Join(lines, "\n"))
+}
+
+// doOverride handles `@bot override <app> <ref> <reason>`, an admin deploying through a freeze
+func (b *Bot) doOverride(text, user string, connInfo slackbot.ConnInfo) {
+	args := strings.Split(text, " ")
+	if len(args) < 4 {
+		msg := fmt.Sprintf("_Usage: @%s override <app> <pr_number/main> <reason>_", os.Getenv("SLACKBOT_NAME"))
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	reason := strings.Join(args[3:], " ")
+	b.enqueueDeploy(strings.Join(args[:3], " "), user, reason, connInfo)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"deploy-bot/argo"
+	"deploy-bot/config"
+	"deploy-bot/internal/fakeargo"
+	"deploy-bot/internal/githook"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGitHook(t *testing.T) {
+	tt := []struct {
+		desc         string
+		payload      string
+		failing      int // Status code for Argo's webhook endpoint
+		wantStatus   int
+		wantWebhooks int
+		wantArrived  bool
+		wantMsg      string
+	}{
+		{"Bot push", "push_bot.json", 0, http.StatusAccepted, 1, true, "Argocd received Github webhook"},
+		{"Human push", "push_human.json", 0, http.StatusAccepted, 0, false, ""},
+		{"Argo down", "push_bot.json", http.StatusBadGateway, http.StatusAccepted, 0, true, "unexpected status 502"},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			tb := newTestBot(t)
+			srv := fakeargo.New()
+			defer srv.Close()
+			t.Setenv("ARGOCD_SERVER", srv.URL)
+			srv.AddApp("time", []string{"time", "time-sidekiq"})
+			srv.Fail(fakeargo.Webhook, v.failing)
+			cd, err := argo.New(config.Argo{})
+			if err != nil {
+				t.Fatalf("Test %d: argo.New() got error %v", i+1, err)
+			}
+			tb.CD = cd
+
+			var mu sync.Mutex
+			var msgs []string
+			w := &hookWaiter{notify: func(msg string) {
+				mu.Lock()
+				msgs = append(msgs, msg)
+				mu.Unlock()
+			}, arrived: make(chan struct{})}
+			tb.hookWaiters.Store("time", w)
+
+			bot := httptest.NewServer(http.HandlerFunc(tb.gitHook))
+			defer bot.Close()
+			payload, err := githook.Load("internal/githook/testdata/" + v.payload)
+			if err != nil {
+				t.Fatalf("Test %d: githook.Load(%s) error: %s", i+1, v.payload, err)
+			}
+			status, err := githook.Replay(bot.URL+"/githook", payload)
+			if err != nil || status != v.wantStatus {
+				t.Fatalf("Test %d: Replay(%s) got %d, %v, want %d", i+1, v.payload, status, err, v.wantStatus)
+			}
+
+			// The hook is handled after the response, so wait for it to land
+			arrived := false
+			select {
+			case <-w.arrived:
+				arrived = true
+			case <-time.After(200 * time.Millisecond):
+			}
+			if arrived != v.wantArrived {
+				t.Errorf("Test %d: %s got arrived %v, want %v", i+1, v.desc, arrived, v.wantArrived)
+			}
+			if got := len(srv.Webhooks()); got != v.wantWebhooks {
+				t.Errorf("Test %d: %s got %d webhooks at Argo, want %d", i+1, v.desc, got, v.wantWebhooks)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if all := strings.Join(msgs, "\n"); !strings.Contains(all, v.wantMsg) {
+				t.Errorf("Test %d: %s sent %q, want a message containing %q", i+1, v.desc, all, v.wantMsg)
+			}
+		})
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"net/http"
 	"os"
 
+	"deploy-bot/logging"
+	"deploy-bot/metrics"
+	"deploy-bot/tracing"
 	"deploy-bot/util"
 	"github.com/google/go-github/v40/github"
 	"github.com/joho/godotenv"
@@ -14,14 +17,16 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-func Client() (context.Context, *github.Client) {
+// Client authenticates with GITHUB_API_TOKEN. Every call takes the context of the
+// deploy making it, so a cancelled deploy stops waiting on GitHub
+func Client() *github.Client {
 	godotenv.Load(".env")
 	token := os.Getenv("GITHUB_API_TOKEN")
-	ctx := context.Background()
 	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
-	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
-	return ctx, client
+	// oauth2 wraps the client it finds in the context, which traces every call
+	traced := &http.Client{Transport: tracing.Transport("github", http.DefaultTransport)}
+	tc := oauth2.NewClient(context.WithValue(context.Background(), oauth2.HTTPClient, traced), ts)
+	return github.NewClient(tc)
 }
 
 func DownloadValues(ctx context.Context, client *github.Client, app string) (io.ReadCloser, *github.RepositoryContent, string, error) {
@@ -31,13 +36,30 @@ func DownloadValues(ctx context.Context, client *github.Client, app string) (io.
 
 	rc, content, _, err := client.Repositories.DownloadContentsWithMeta(ctx, util.Owner, repo, path, &opts)
 	if err != nil {
-		log.Printf("Error downloading contents with meta: %v", err)
+		logging.Errorf("Error downloading contents with meta: %v", err)
 		return nil, nil, "", err
 	}
 	dlMsg := fmt.Sprintf("_ Downloading %s _", content.GetHTMLURL())
 	return rc, content, dlMsg, err
 }
 
+// CurrentImageTag reads image.tag from the app's values file on main
+func CurrentImageTag(ctx context.Context, client *github.Client, app string) (string, error) {
+	rc, _, _, err := DownloadValues(ctx, client, app)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	bytes, _ := io.ReadAll(rc)
+	m := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(bytes, &m); err != nil {
+		return "", err
+	}
+	image, _ := m["image"].(map[interface{}]interface{})
+	tag, _ := image["tag"].(string)
+	return tag, nil
+}
+
 func UpdateValues(rc io.Reader, imgTag string) ([]byte, error, string) {
 	bytes, _ := io.ReadAll(rc)
 	oldValues := string(bytes)
@@ -49,7 +71,7 @@ func updateValuesFileContent(content, imgTag string) ([]byte, error, string) {
 	m := make(map[interface{}]interface{})
 	err := yaml.Unmarshal([]byte(content), &m)
 	if err != nil {
-		log.Printf("Error updating values file content: %v", err)
+		logging.Errorf("Error updating values file content: %v", err)
 	}
 	// TODO: FIX THIS
 	tag := m["image"].(map[interface{}]interface{})["tag"]
@@ -62,7 +84,8 @@ func updateValuesFileContent(content, imgTag string) ([]byte, error, string) {
 	return bytes, err, ""
 }
 
-func PushCommit(ctx context.Context, client *github.Client, app, imgTag string, values []byte, content *github.RepositoryContent) error {
+// PushCommit commits the new values file to the gitops repo, returning the commit SHA
+func PushCommit(ctx context.Context, client *github.Client, app, imgTag string, values []byte, content *github.RepositoryContent) (string, error) {
 	repo, path := util.GetRepoAndPath(app)
 	branch := "main"
 	commitMsg := fmt.Sprintf("Deploy %s:%s", app, imgTag)
@@ -73,19 +96,27 @@ func PushCommit(ctx context.Context, client *github.Client, app, imgTag string,
 		SHA:     content.SHA,
 	}
 
-	_, _, err := client.Repositories.UpdateFile(ctx, util.Owner, repo, path, &opts)
+	resp, _, err := client.Repositories.UpdateFile(ctx, util.Owner, repo, path, &opts)
 	if err != nil {
-		log.Printf("Error updating file: %s", err.Error())
-		return err
+		logging.Errorf("Error updating file: %s", err.Error())
+		return "", err
 	}
-	return nil
+	return resp.Commit.GetSHA(), nil
+}
+
+// GitopsCommitURL links to a commit pushed to the gitops repo
+func GitopsCommitURL(sha string) string {
+	repo, _ := util.GetRepoAndPath("")
+	return fmt.Sprintf("https://github.com/%s/%s/commit/%s", util.Owner, repo, sha)
 }
 
 // Check that all checks have passed on latest commit for specified PR
 func ConfirmChecksCompleted(ctx context.Context, client *github.Client, app, sha string, opts *github.ListCheckRunsOptions) bool {
 	crr, _, err := client.Checks.ListCheckRunsForRef(ctx, util.Owner, app, sha, nil)
+	metrics.APIError("github", "list_check_runs", err)
 	if err != nil {
-		log.Printf("Error confiring checks completed: %v", err)
+		logging.Errorf("Error confiring checks completed: %v", err)
+		return false
 	}
 
 	for _, cr := range crr.CheckRuns {
@@ -101,3 +132,120 @@ func GetPullRequest(ctx context.Context, client *github.Client, app string, prNu
 	pr, resp, err := client.PullRequests.Get(ctx, util.Owner, app, prNum)
 	return pr, resp, err
 }
+
+// CreateDeployment records a deploy of sha to env on the app's repo, returning its ID.
+// Required status checks were already verified by the bot, so GitHub isn't asked to check them again
+func CreateDeployment(ctx context.Context, client *github.Client, app, sha, env, desc string) (int64, error) {
+	production := env == "production"
+	req := github.DeploymentRequest{
+		Ref:                   &sha,
+		Environment:           &env,
+		Description:           &desc,
+		AutoMerge:             github.Bool(false),
+		RequiredContexts:      &[]string{},
+		ProductionEnvironment: &production,
+	}
+	d, _, err := client.Repositories.CreateDeployment(ctx, util.Owner, app, &req)
+	if err != nil {
+		return 0, err
+	}
+	return d.GetID(), nil
+}
+
+// SetDeploymentStatus moves a deployment to state (in_progress, success or failure).
+// A successful deployment marks the previous one to the same environment inactive
+func SetDeploymentStatus(ctx context.Context, client *github.Client, app string, id int64, state, desc, logURL, envURL string) error {
+	req := github.DeploymentStatusRequest{
+		State:          &state,
+		Description:    &desc,
+		LogURL:         &logURL,
+		EnvironmentURL: &envURL,
+		AutoInactive:   github.Bool(true),
+	}
+	_, _, err := client.Repositories.CreateDeploymentStatus(ctx, util.Owner, app, id, &req)
+	return err
+}
+
+// CommentOnPR adds a comment to the app's PR
+func CommentOnPR(ctx context.Context, client *github.Client, app string, prNum int, body string) error {
+	_, _, err := client.Issues.CreateComment(ctx, util.Owner, app, prNum, &github.IssueComment{Body: &body})
+	return err
+}
+
+// Repos is the live pipeline.SourceRepo for the app repos and pipeline.GitOpsStore for the gitops repo
+type Repos struct {
+	Client *github.Client
+}
+
+func NewRepos() *Repos {
+	return &Repos{Client: Client()}
+}
+
+// Check is the readiness check for GitHub, confirming GITHUB_API_TOKEN is valid
+func (r *Repos) Check(ctx context.Context) error {
+	_, _, err := r.Client.Users.Get(ctx, "")
+	metrics.APIError("github", "get_user", err)
+	return err
+}
+
+func (r *Repos) PullRequest(ctx context.Context, app string, number int) (*github.PullRequest, error) {
+	pr, resp, err := GetPullRequest(ctx, r.Client, app, number)
+	if resp != nil && resp.StatusCode == 404 {
+		return nil, nil
+	}
+	metrics.APIError("github", "get_pull_request", err)
+	return pr, err
+}
+
+func (r *Repos) HeadCommit(ctx context.Context, app, branch string) (string, error) {
+	opts := &github.CommitsListOptions{SHA: branch, ListOptions: github.ListOptions{PerPage: 1}}
+	commits, _, err := r.Client.Repositories.ListCommits(ctx, util.Owner, app, opts)
+	metrics.APIError("github", "list_commits", err)
+	if err != nil {
+		return "", err
+	}
+	if len(commits) == 0 {
+		return "", fmt.Errorf("%s has no commits on %s", app, branch)
+	}
+	return commits[0].GetSHA(), nil
+}
+
+func (r *Repos) ChecksCompleted(ctx context.Context, app, sha string) bool {
+	return ConfirmChecksCompleted(ctx, r.Client, app, sha, nil)
+}
+
+func (r *Repos) CreateDeployment(ctx context.Context, app, sha, env, desc string) (int64, error) {
+	id, err := CreateDeployment(ctx, r.Client, app, sha, env, desc)
+	metrics.APIError("github", "create_deployment", err)
+	return id, err
+}
+
+func (r *Repos) SetDeploymentStatus(ctx context.Context, app string, id int64, state, desc, logURL, envURL string) error {
+	err := SetDeploymentStatus(ctx, r.Client, app, id, state, desc, logURL, envURL)
+	metrics.APIError("github", "set_deployment_status", err)
+	return err
+}
+
+func (r *Repos) CommentOnPR(ctx context.Context, app string, number int, body string) error {
+	err := CommentOnPR(ctx, r.Client, app, number, body)
+	metrics.APIError("github", "comment_on_pr", err)
+	return err
+}
+
+func (r *Repos) DownloadValues(ctx context.Context, app string) (io.ReadCloser, *github.RepositoryContent, error) {
+	rc, content, _, err := DownloadValues(ctx, r.Client, app)
+	metrics.APIError("github", "download_values", err)
+	return rc, content, err
+}
+
+func (r *Repos) PushValues(ctx context.Context, app, imgTag string, values []byte, content *github.RepositoryContent) (string, error) {
+	sha, err := PushCommit(ctx, r.Client, app, imgTag, values, content)
+	metrics.APIError("github", "push_values", err)
+	return sha, err
+}
+
+func (r *Repos) CurrentImageTag(ctx context.Context, app string) (string, error) {
+	tag, err := CurrentImageTag(ctx, r.Client, app)
+	metrics.APIError("github", "current_image_tag", err)
+	return tag, err
+}
@@ -0,0 +1,126 @@
+// Package health serves the liveness and readiness probes. Readiness runs a check per
+// dependency and caches the results, so frequent probes don't hammer GitHub, AWS,
+// Argo CD and Slack
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check returns an error when the dependency it checks is unusable
+type Check func(ctx context.Context) error
+
+// Result is the last outcome of one check
+type Result struct {
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Checker runs named checks, reusing each result for TTL
+type Checker struct {
+	TTL     time.Duration
+	Timeout time.Duration // For each check
+
+	mu      sync.Mutex
+	names   []string
+	checks  map[string]Check
+	results map[string]Result
+	now     func() time.Time
+}
+
+func New(ttl, timeout time.Duration) *Checker {
+	return &Checker{
+		TTL:     ttl,
+		Timeout: timeout,
+		checks:  make(map[string]Check),
+		results: make(map[string]Result),
+		now:     time.Now,
+	}
+}
+
+// Add registers a check under name, e.g. "github"
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+		sort.Strings(c.names)
+	}
+	c.checks[name] = check
+}
+
+// Check reruns any check whose result is older than TTL, concurrently, and returns
+// whether every check passed along with each one's result. Checks get their own
+// timeout rather than the probe's context, so a probe that hangs up doesn't leave
+// a cancelled check cached as a failure for every probe after it
+func (c *Checker) Check() (bool, map[string]Result) {
+	// Held throughout, so simultaneous probes wait for one run rather than each starting their own
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var freshMu sync.Mutex
+	fresh := make(map[string]Result)
+	now := c.now()
+	for _, name := range c.names {
+		if r, ok := c.results[name]; ok && now.Sub(r.CheckedAt) < c.TTL {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+			defer cancel()
+			r := Result{OK: true, CheckedAt: now}
+			if err := check(ctx); errors.Is(err, context.Canceled) {
+				return // Says nothing about the dependency, so it's checked again next time
+			} else if err != nil {
+				r = Result{Error: err.Error(), CheckedAt: now}
+			}
+			freshMu.Lock()
+			fresh[name] = r
+			freshMu.Unlock()
+		}(name, c.checks[name])
+	}
+	wg.Wait()
+	for name, r := range fresh {
+		c.results[name] = r
+	}
+
+	ready := true
+	results := make(map[string]Result, len(c.names))
+	for _, name := range c.names {
+		results[name] = c.results[name]
+		ready = ready && c.results[name].OK
+	}
+	return ready, results
+}
+
+// Ready serves GET /readyz: 200 when every check passes and 503 otherwise, with
+// a JSON breakdown of which dependency is failing and why
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	ready, results := c.Check()
+	status := "ok"
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		status = "failing"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Status string            `json:"status"`
+		Checks map[string]Result `json:"checks"`
+	}{status, results})
+}
+
+// Alive serves GET /healthz, answering as long as the process can serve HTTP at all
+func Alive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
@@ -0,0 +1,83 @@
+package health_test
+
+import (
+	"context"
+	"deploy-bot/health"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// check counts its calls and fails with err
+type check struct {
+	calls int
+	err   error
+}
+
+func (c *check) run(ctx context.Context) error {
+	c.calls++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.err
+}
+
+func TestReady(t *testing.T) {
+	tt := []struct {
+		desc       string
+		ttl        time.Duration
+		githubErr  error
+		hangUp     bool // Probes cancel their requests
+		wantStatus int
+		wantCalls  int // Of each check, over two probes
+		wantError  string
+	}{
+		{"All passing", time.Hour, nil, false, http.StatusOK, 1, ""},
+		{"GitHub failing", time.Hour, errors.New("401 Bad credentials"), false, http.StatusServiceUnavailable, 1, "401 Bad credentials"},
+		{"Not cached", 0, nil, false, http.StatusOK, 2, ""},
+		{"Probes hanging up", time.Hour, nil, true, http.StatusOK, 1, ""},
+		{"Cancelled checks not cached", time.Hour, context.Canceled, false, http.StatusServiceUnavailable, 2, ""},
+	}
+	for i, c := range tt {
+		t.Run(c.desc, func(t *testing.T) {
+			github, slack := &check{err: c.githubErr}, &check{}
+			checker := health.New(c.ttl, time.Second)
+			checker.Add("github", github.run)
+			checker.Add("slack", slack.run)
+
+			var rec *httptest.ResponseRecorder
+			for n := 0; n < 2; n++ {
+				rec = httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+				if c.hangUp {
+					ctx, cancel := context.WithCancel(req.Context())
+					cancel()
+					req = req.WithContext(ctx)
+				}
+				checker.Ready(rec, req)
+			}
+			if rec.Code != c.wantStatus {
+				t.Errorf("Test %d: Ready() got status %d, want %d", i+1, rec.Code, c.wantStatus)
+			}
+			if github.calls != c.wantCalls {
+				t.Errorf("Test %d: Ready() ran the github check %d times, want %d", i+1, github.calls, c.wantCalls)
+			}
+			var body struct {
+				Status string                   `json:"status"`
+				Checks map[string]health.Result `json:"checks"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("Test %d: Ready() got invalid JSON: %s", i+1, err)
+			}
+			if got := body.Checks["github"]; got.OK != (c.githubErr == nil) || got.Error != c.wantError {
+				t.Errorf("Test %d: Ready() got github %+v, want error %q", i+1, got, c.wantError)
+			}
+			if !body.Checks["slack"].OK {
+				t.Errorf("Test %d: Ready() got slack %+v, want ok", i+1, body.Checks["slack"])
+			}
+		})
+	}
+}
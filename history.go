@@ -0,0 +1,127 @@
+package main
+
+import (
+	"deploy-bot/audit"
+	"deploy-bot/auth"
+	"deploy-bot/logging"
+	"deploy-bot/metrics"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"deploy-bot/util"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistory = 5
+	maxHistory     = 50
+)
+
+func (b *Bot) saveDeploy(record *store.Deploy) {
+	if err := b.History.Save(record); err != nil {
+		logging.Errorf("Error saving deploy #%d: %s", record.ID, err)
+	}
+}
+
+func (b *Bot) finishRecord(record *store.Deploy, result string) {
+	record.Stage = store.StageDone
+	record.Result = result
+	record.FinishedAt = time.Now()
+	b.saveDeploy(record)
+	metrics.Deploys.WithLabelValues(record.App, record.Environment, metrics.Outcome(result)).Inc()
+	b.auditEvent(audit.Entry{
+		Actor:   record.Requester,
+		Action:  "deploy",
+		Channel: record.Channel,
+		App:     record.App,
+		Env:     record.Environment,
+		Outcome: result,
+		Detail:  fmt.Sprintf("deploy #%d of %s (%s)", record.ID, record.Ref, record.ImageTag),
+	})
+}
+
+func (b *Bot) failDeploy(record *store.Deploy, reason string) {
+	b.finishRecord(record, "failed: "+reason)
+}
+
+// doHistory handles `@bot history <app> [n]`
+func (b *Bot) doHistory(text, user string, connInfo slackbot.ConnInfo) {
+	args := strings.Split(text, " ")
+	n := defaultHistory
+	if len(args) == 3 {
+		n, _ = strconv.Atoi(args[2])
+	}
+	if len(args) < 2 || len(args) > 3 || n < 1 {
+		msg := fmt.Sprintf("_Usage: @%s history <app> [n]_", os.Getenv("SLACKBOT_NAME"))
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	app := args[1]
+	if util.CheckAppValid(app) != true {
+		msg := fmt.Sprintf("_私は認識しません, translation: I do not recognize %s app_", app)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if !b.authorize(user, app, auth.Viewer, connInfo) {
+		return
+	}
+	if n > maxHistory {
+		n = maxHistory
+	}
+
+	deploys, err := b.History.History(app, n)
+	if err != nil {
+		msg := fmt.Sprintf("_Error reading deploy history: %s_", err)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if len(deploys) == 0 {
+		msg := fmt.Sprintf("_`%s` has never been deployed by me_", app)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	lines := make([]string, len(deploys))
+	for i, d := range deploys {
+		lines[i] = d.String()
+	}
+	b.Slack.SendMessage(connInfo, strings.Join(lines, "\n"))
+}
+
+// historyHandler serves GET /history?app=<app>&n=<n> as JSON for dashboards, at most
+// maxHistory records at a time. It has no authentication of its own, so it must only be
+// reachable from inside the cluster
+func (b *Bot) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	app := r.URL.Query().Get("app")
+	n := maxHistory
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if n > maxHistory {
+			n = maxHistory
+		}
+	}
+
+	deploys, err := b.History.History(app, n)
+	if err != nil {
+		logging.Errorf("Error reading deploy history: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if deploys == nil {
+		deploys = []store.Deploy{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deploys)
+}
@@ -0,0 +1,298 @@
+// Package fakeargo is a stand-in Argo CD API server for integration tests. It serves
+// the endpoints the bot uses and walks each app through a scripted series of states
+// once a sync is requested
+package fakeargo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// State is what Argo reports for every deployment of an app at one point in a sync
+type State struct {
+	Sync   string // Synced, OutOfSync or Unknown
+	Health string // Healthy, Progressing, Degraded or Missing
+}
+
+var (
+	Synced      = State{"Synced", "Healthy"}
+	OutOfSync   = State{"OutOfSync", "Healthy"}
+	Progressing = State{"Synced", "Progressing"}
+	Degraded    = State{"Synced", "Degraded"}
+)
+
+// App is an Argo application with the deployments the bot watches
+type App struct {
+	Deployments []string
+	Modified    []string // Resources Diff reports as differing from git, as Kind/name
+	// Token is the only one accepted for the app when set, like a project-scoped token
+	Token string
+
+	state  State
+	script []State
+	syncs  int
+}
+
+// Server serves the Argo CD API on a local port
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	apps     map[string]*App
+	webhooks [][]byte
+	failures map[string]int // Status codes to answer with instead, keyed by endpoint
+	Token    string         // Bearer token to require, any when empty
+	users    map[string]string
+	sessions map[string]bool
+	logins   int
+}
+
+// Endpoints that can be made to fail with Fail
+const (
+	Webhook = "webhook"
+	Sync    = "sync"
+	Status  = "status"
+	Diff    = "diff"
+	// UserInfo is what readiness checks the token against
+	UserInfo = "userinfo"
+	Login    = "login"
+)
+
+func New() *Server {
+	s := &Server{apps: make(map[string]*App), failures: make(map[string]int), users: make(map[string]string), sessions: make(map[string]bool)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// NewTLS serves over HTTPS with a certificate clients only trust given Certificate().
+// When clientCAs isn't nil it also requires a client certificate signed by one of them
+func NewTLS(clientCAs *x509.CertPool) *Server {
+	s := &Server{apps: make(map[string]*App), failures: make(map[string]int), users: make(map[string]string), sessions: make(map[string]bool)}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	if clientCAs != nil {
+		s.Server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	}
+	s.StartTLS()
+	return s
+}
+
+// AddApp adds an app that is Synced until a webhook arrives. After a sync is requested,
+// each status request returns the next state of script, staying on the last one
+func (s *Server) AddApp(name string, deployments []string, script ...State) *App {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := &App{Deployments: deployments, state: Synced, script: script}
+	s.apps[name] = a
+	return a
+}
+
+// Fail makes the endpoint answer with status until Fail is called again with 0
+func (s *Server) Fail(endpoint string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[endpoint] = status
+}
+
+// AddUser lets username log in with password. Session tokens are accepted alongside Token
+func (s *Server) AddUser(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[username] = password
+}
+
+// ExpireSessions makes every session token issued so far answer 401, as Argo does once they expire
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]bool)
+}
+
+// Logins returns how many sessions have been created
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// Webhooks returns the bodies of every webhook received
+func (s *Server) Webhooks() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.webhooks...)
+}
+
+// Syncs returns how many syncs have been requested for the app
+func (s *Server) Syncs(app string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.apps[app]; ok {
+		return a.syncs
+	}
+	return 0
+}
+
+// authorized checks the request's bearer token for app, or for the API generally when
+// app is nil, where an app's own token is valid too. Callers hold s.mu
+func (s *Server) authorized(r *http.Request, app *App) bool {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if app != nil && app.Token != "" {
+		return bearer == app.Token
+	}
+	if app == nil {
+		for _, a := range s.apps {
+			if a.Token != "" && bearer == a.Token {
+				return true
+			}
+		}
+	}
+	return s.sessions[bearer] || s.Token == "" || bearer == s.Token
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case path == "api/v1/session" && r.Method == http.MethodPost:
+		if s.fail(w, Login) {
+			return
+		}
+		var creds struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		json.NewDecoder(r.Body).Decode(&creds)
+		if password, ok := s.users[creds.Username]; !ok || password != creds.Password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.logins++
+		tok := fmt.Sprintf("session-%d", s.logins)
+		s.sessions[tok] = true
+		writeJSON(w, map[string]string{"token": tok})
+		return
+	case path == "api/v1/session/userinfo" && r.Method == http.MethodGet:
+		if s.fail(w, UserInfo) {
+			return
+		}
+		// Like Argo CD, a bad token is not an error here, just not logged in
+		writeJSON(w, map[string]interface{}{"loggedIn": s.authorized(r, nil), "iss": "argocd"})
+		return
+	case !strings.HasPrefix(path, "api/v1/applications/") && !s.authorized(r, nil):
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if path == "api/webhook" && r.Method == http.MethodPost {
+		if s.fail(w, Webhook) {
+			return
+		}
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(r.Body)
+		}
+		s.webhooks = append(s.webhooks, body)
+		for _, a := range s.apps {
+			if a.syncs == 0 {
+				a.state = OutOfSync
+			}
+		}
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "api/v1/applications/"), "/")
+	if !strings.HasPrefix(path, "api/v1/applications/") || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	a, ok := s.apps[parts[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorized(r, a) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		if s.fail(w, Status) {
+			return
+		}
+		if a.syncs > 0 && len(a.script) > 0 {
+			a.state, a.script = a.script[0], a.script[1:]
+			if len(a.script) == 0 {
+				a.script = []State{a.state}
+			}
+		}
+		writeJSON(w, a.application())
+	case parts[1] == "sync" && r.Method == http.MethodPost:
+		if s.fail(w, Sync) {
+			return
+		}
+		a.syncs++
+		writeJSON(w, map[string]interface{}{})
+	case parts[1] == "managed-resources" && r.Method == http.MethodGet:
+		if s.fail(w, Diff) {
+			return
+		}
+		writeJSON(w, a.managedResources())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fail writes the failure set for endpoint, if any. Callers hold s.mu
+func (s *Server) fail(w http.ResponseWriter, endpoint string) bool {
+	if status := s.failures[endpoint]; status != 0 {
+		w.WriteHeader(status)
+		return true
+	}
+	return false
+}
+
+func (a *App) application() map[string]interface{} {
+	var resources []map[string]interface{}
+	for _, d := range a.Deployments {
+		resources = append(resources, map[string]interface{}{
+			"kind":   "Deployment",
+			"name":   d,
+			"status": a.state.Sync,
+			"health": map[string]string{"status": a.state.Health},
+		})
+	}
+	resources = append(resources, map[string]interface{}{"kind": "Service", "name": "svc", "status": a.state.Sync})
+	return map[string]interface{}{
+		"status": map[string]interface{}{
+			"sync":      map[string]string{"status": a.state.Sync},
+			"health":    map[string]string{"status": a.state.Health},
+			"resources": resources,
+		},
+	}
+}
+
+func (a *App) managedResources() map[string]interface{} {
+	var items []map[string]interface{}
+	for _, r := range a.Modified {
+		kind, name := r, ""
+		if i := strings.Index(r, "/"); i >= 0 {
+			kind, name = r[:i], r[i+1:]
+		}
+		items = append(items, map[string]interface{}{"kind": kind, "name": name, "modified": true})
+	}
+	return map[string]interface{}{"items": items}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,56 @@
+package fakes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CD is a pipeline.CDController that syncs every app to Result, "Synced" by default
+type CD struct {
+	mu        sync.Mutex
+	Result    string
+	Hang      bool // WatchSync waits for its context instead, like a sync that never finishes
+	Gitshots  int
+	Syncs     int // Sync requests, WatchSync re-attaches without one
+	Synced    []string
+	OutOfSync []string // What Diff reports
+}
+
+func NewCD() *CD {
+	return &CD{Result: "Synced"}
+}
+
+func (c *CD) ForwardGitshot(ctx context.Context, payload io.Reader) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Gitshots++
+	return "_Gitshot forwarded to Argo_", nil
+}
+
+func (c *CD) Sync(ctx context.Context, app string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Syncs++
+	return fmt.Sprintf("_Syncing `%s`_", app), nil
+}
+
+func (c *CD) Diff(ctx context.Context, app string) ([]string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.OutOfSync, "", nil
+}
+
+func (c *CD) WatchSync(ctx context.Context, app string, notify func(msg string)) string {
+	c.mu.Lock()
+	result, hang := c.Result, c.Hang
+	c.Synced = append(c.Synced, app)
+	c.mu.Unlock()
+	if hang {
+		<-ctx.Done()
+		return ctx.Err().Error()
+	}
+	notify(fmt.Sprintf("`_%s` %s_", app, result))
+	return result
+}
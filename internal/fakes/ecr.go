@@ -0,0 +1,28 @@
+package fakes
+
+import (
+	"context"
+	"sync"
+)
+
+// Registry is a pipeline.ImageRegistry holding the tags pushed for each app
+type Registry struct {
+	mu     sync.Mutex
+	images map[string]bool // Keyed app:tag
+}
+
+func NewRegistry() *Registry {
+	return &Registry{images: make(map[string]bool)}
+}
+
+func (r *Registry) Push(app, tag string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.images[app+":"+tag] = true
+}
+
+func (r *Registry) ImageExists(ctx context.Context, app, tag string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.images[app+":"+tag], nil
+}
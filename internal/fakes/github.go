@@ -0,0 +1,201 @@
+// Package fakes has in-memory stand-ins for the services a deploy talks to,
+// for driving the bot end to end in tests
+package fakes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v40/github"
+)
+
+// Deployment is a GitHub Deployment created through Repo, with every status it was given
+type Deployment struct {
+	App, SHA, Env string
+	Statuses      []string
+}
+
+// Repo is a pipeline.SourceRepo holding PRs, branch heads and promoted images per app
+type Repo struct {
+	mu          sync.Mutex
+	prs         map[string]*github.PullRequest // Keyed app#number
+	heads       map[string]string              // Keyed app/branch
+	promoted    map[string]bool                // SHAs whose images have been promoted
+	deployments []*Deployment
+	comments    map[string][]string // Keyed app#number
+}
+
+func NewRepo() *Repo {
+	return &Repo{
+		prs:      make(map[string]*github.PullRequest),
+		heads:    make(map[string]string),
+		promoted: make(map[string]bool),
+		comments: make(map[string][]string),
+	}
+}
+
+// Deployments returns a copy of every deployment created so far
+func (r *Repo) Deployments() []Deployment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ds := make([]Deployment, len(r.deployments))
+	for i, d := range r.deployments {
+		ds[i] = *d
+		ds[i].Statuses = append([]string(nil), d.Statuses...)
+	}
+	return ds
+}
+
+// Comments returns the comments made on PR number of app
+func (r *Repo) Comments(app string, number int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.comments[fmt.Sprintf("%s#%d", app, number)]...)
+}
+
+// AddPR opens PR number of app from branch at sha, with its checks complete
+func (r *Repo) AddPR(app string, number int, branch, sha string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prs[fmt.Sprintf("%s#%d", app, number)] = &github.PullRequest{
+		Number:  github.Int(number),
+		HTMLURL: github.String(fmt.Sprintf("https://github.example/%s/pull/%d", app, number)),
+		Head:    &github.PullRequestBranch{Ref: github.String(branch), SHA: github.String(sha)},
+	}
+	r.promoted[sha] = true
+}
+
+// SetHead points app's branch at sha, with its checks complete
+func (r *Repo) SetHead(app, branch, sha string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.heads[app+"/"+branch] = sha
+	r.promoted[sha] = true
+}
+
+func (r *Repo) PullRequest(ctx context.Context, app string, number int) (*github.PullRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.prs[fmt.Sprintf("%s#%d", app, number)], nil
+}
+
+func (r *Repo) HeadCommit(ctx context.Context, app, branch string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sha, ok := r.heads[app+"/"+branch]
+	if !ok {
+		return "", fmt.Errorf("%s has no branch %s", app, branch)
+	}
+	return sha, nil
+}
+
+func (r *Repo) ChecksCompleted(ctx context.Context, app, sha string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.promoted[sha]
+}
+
+func (r *Repo) CreateDeployment(ctx context.Context, app, sha, env, desc string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deployments = append(r.deployments, &Deployment{App: app, SHA: sha, Env: env})
+	return int64(len(r.deployments)), nil
+}
+
+func (r *Repo) SetDeploymentStatus(ctx context.Context, app string, id int64, state, desc, logURL, envURL string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id < 1 || int(id) > len(r.deployments) {
+		return fmt.Errorf("no deployment %d", id)
+	}
+	d := r.deployments[id-1]
+	d.Statuses = append(d.Statuses, state)
+	return nil
+}
+
+func (r *Repo) CommentOnPR(ctx context.Context, app string, number int, body string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := fmt.Sprintf("%s#%d", app, number)
+	r.comments[key] = append(r.comments[key], body)
+	return nil
+}
+
+// GitOps is a pipeline.GitOpsStore holding each app's values file
+type GitOps struct {
+	mu      sync.Mutex
+	values  map[string]string
+	commits []string
+
+	// OnPush, if set, is called after every push, e.g. to send the githook
+	OnPush func(app, sha string)
+}
+
+func NewGitOps() *GitOps {
+	return &GitOps{values: make(map[string]string)}
+}
+
+// SetValues replaces app's values file
+func (g *GitOps) SetValues(app, values string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[app] = values
+}
+
+// Commits returns the SHAs of every push, oldest first
+func (g *GitOps) Commits() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.commits...)
+}
+
+func (g *GitOps) Values(app string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[app]
+}
+
+func (g *GitOps) DownloadValues(ctx context.Context, app string) (io.ReadCloser, *github.RepositoryContent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	values, ok := g.values[app]
+	if !ok {
+		return nil, nil, fmt.Errorf("%s/values.yaml not found", app)
+	}
+	content := &github.RepositoryContent{
+		Path:    github.String(app + "/values.yaml"),
+		SHA:     github.String(fmt.Sprintf("blob%d", len(g.commits))),
+		HTMLURL: github.String(fmt.Sprintf("https://github.example/gitops/blob/main/%s/values.yaml", app)),
+	}
+	return io.NopCloser(strings.NewReader(values)), content, nil
+}
+
+func (g *GitOps) PushValues(ctx context.Context, app, imgTag string, values []byte, content *github.RepositoryContent) (string, error) {
+	g.mu.Lock()
+	if want := fmt.Sprintf("blob%d", len(g.commits)); content.GetSHA() != want {
+		g.mu.Unlock()
+		return "", fmt.Errorf("%s has changed since it was downloaded", content.GetPath())
+	}
+	g.values[app] = string(values)
+	sha := fmt.Sprintf("%040d", len(g.commits)+1)
+	g.commits = append(g.commits, sha)
+	onPush := g.OnPush
+	g.mu.Unlock()
+
+	if onPush != nil {
+		onPush(app, sha)
+	}
+	return sha, nil
+}
+
+func (g *GitOps) CurrentImageTag(ctx context.Context, app string) (string, error) {
+	for _, line := range strings.Split(g.Values(app), "\n") {
+		if tag := strings.TrimPrefix(strings.TrimSpace(line), "tag:"); tag != strings.TrimSpace(line) {
+			return strings.Trim(strings.TrimSpace(tag), `"`), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,121 @@
+package fakes
+
+import (
+	slackbot "deploy-bot/slack"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Message is what a thread shows for one message. Edits replace Text
+type Message struct {
+	Channel, Thread, TS string
+	Text                string
+}
+
+// Slack is the bot's Notifier, keeping every message in the order it was posted
+type Slack struct {
+	mu       sync.Mutex
+	messages []*Message
+	changed  chan struct{} // Closed and replaced whenever a message is posted or edited
+}
+
+func NewSlack() *Slack {
+	return &Slack{changed: make(chan struct{})}
+}
+
+func (s *Slack) post(conn slackbot.ConnInfo, text string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := fmt.Sprintf("%d.000100", 1000+len(s.messages))
+	s.messages = append(s.messages, &Message{Channel: conn.Channel, Thread: conn.Timestamp, TS: ts, Text: text})
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return ts
+}
+
+func (s *Slack) SendMessage(conn slackbot.ConnInfo, msg string) {
+	s.post(conn, msg)
+}
+
+func (s *Slack) PostBlocks(conn slackbot.ConnInfo, fallback string, blocks ...slack.Block) (string, error) {
+	return s.post(conn, blockText(blocks)), nil
+}
+
+func (s *Slack) UpdateBlocks(conn slackbot.ConnInfo, ts, fallback string, blocks ...slack.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages {
+		if m.Channel == conn.Channel && m.TS == ts {
+			m.Text = blockText(blocks)
+			close(s.changed)
+			s.changed = make(chan struct{})
+			return nil
+		}
+	}
+	return fmt.Errorf("message_not_found")
+}
+
+func (s *Slack) Permalink(conn slackbot.ConnInfo) string {
+	return fmt.Sprintf("https://slack.example/archives/%s/p%s", conn.Channel, strings.Replace(conn.Timestamp, ".", "", 1))
+}
+
+func (s *Slack) UserName(user string) string {
+	return "name-of-" + user
+}
+
+// Thread returns the text of every message in the thread, oldest first
+func (s *Slack) Thread(channel, thread string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var texts []string
+	for _, m := range s.messages {
+		if m.Channel == channel && m.Thread == thread {
+			texts = append(texts, m.Text)
+		}
+	}
+	return texts
+}
+
+// WaitFor waits until a message in the thread contains text, returning false if none does within timeout
+func (s *Slack) WaitFor(channel, thread, text string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+		for _, m := range s.Thread(channel, thread) {
+			if strings.Contains(m, text) {
+				return true
+			}
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// blockText flattens the text of sections and contexts, one block per line
+func blockText(blocks []slack.Block) string {
+	var lines []string
+	for _, b := range blocks {
+		switch b := b.(type) {
+		case *slack.SectionBlock:
+			if b.Text != nil {
+				lines = append(lines, b.Text.Text)
+			}
+		case *slack.ContextBlock:
+			for _, e := range b.ContextElements.Elements {
+				if t, ok := e.(*slack.TextBlockObject); ok {
+					lines = append(lines, t.Text)
+				}
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
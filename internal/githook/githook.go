@@ -0,0 +1,37 @@
+// Package githook replays recorded GitHub push webhooks at the bot, as GitHub would
+// deliver them after a commit lands in the gitops repo
+package githook
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+var delivery int64
+
+// Load reads a recorded payload, such as those in testdata
+func Load(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+// Replay posts payload to url with the headers GitHub sends with a push,
+// returning the status the bot answered with
+func Replay(url string, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GitHub-Hookshot/replay")
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-GitHub-Delivery", fmt.Sprintf("replay-%d", atomic.AddInt64(&delivery, 1)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
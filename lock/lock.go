@@ -0,0 +1,104 @@
+package lock
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Lock covers an app in every environment. Env is only where it was taken from, for messages
+type Lock struct {
+	App    string
+	Env    string // Environment of the channel it was taken in
+	Holder string // Slack user ID
+	Reason string
+	Since  time.Time
+	// Held by a running deploy rather than `@bot lock`. It lasts as long as the deploy,
+	// which releases it however it ends, and locks don't outlive a restart
+	Auto bool
+}
+
+func (l *Lock) Age() time.Duration {
+	return time.Since(l.Since).Round(time.Second)
+}
+
+func (l *Lock) String() string {
+	msg := fmt.Sprintf("`%s` is locked by <@%s> from %s for %s", l.App, l.Holder, l.Env, l.Age())
+	if l.Reason != "" {
+		msg += fmt.Sprintf(": %s", l.Reason)
+	}
+	return msg
+}
+
+type Manager struct {
+	mu    sync.Mutex
+	locks map[string]*Lock
+}
+
+func NewManager() *Manager {
+	return &Manager{locks: make(map[string]*Lock)}
+}
+
+// key is the gitops target a lock protects. Every environment's deploys of an app write
+// the same <app>/values.yaml and sync the same Argo app, so the lock is per app whatever
+// channel, and so environment, it was taken from
+func key(app string) string {
+	return app
+}
+
+// get returns the current lock for app. Callers must hold m.mu
+func (m *Manager) get(app string) *Lock {
+	return m.locks[key(app)]
+}
+
+// Acquire takes the lock for app on behalf of holder, noting env for messages. If somebody else
+// already holds it, their lock is returned along with false. A holder re-acquiring
+// their own lock gets the existing one back, so a user can deploy an app they locked
+func (m *Manager) Acquire(app, env, holder, reason string, auto bool) (*Lock, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l := m.get(app); l != nil {
+		return l, l.Holder == holder && !l.Auto
+	}
+	l := &Lock{
+		App:    app,
+		Env:    env,
+		Holder: holder,
+		Reason: reason,
+		Since:  time.Now(),
+		Auto:   auto,
+	}
+	m.locks[key(app)] = l
+	return l, true
+}
+
+// Release drops the lock for app if holder owns it, or unconditionally when force is set.
+// The released lock is returned, or the lock still in place if holder did not own it
+func (m *Manager) Release(app, holder string, force bool) (*Lock, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.get(app)
+	if l == nil {
+		return nil, false
+	}
+	if l.Holder != holder && !force {
+		return l, false
+	}
+	delete(m.locks, key(app))
+	return l, true
+}
+
+// ReleaseDeploy drops the lock for app only if it was taken automatically by a deploy
+func (m *Manager) ReleaseDeploy(app string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l := m.get(app); l != nil && l.Auto {
+		delete(m.locks, key(app))
+	}
+}
+
+func (m *Manager) Get(app string) *Lock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(app)
+}
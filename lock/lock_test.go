@@ -0,0 +1,54 @@
+package lock_test
+
+import (
+	"deploy-bot/lock"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	tt := []struct {
+		desc   string
+		holder string
+		app    string
+		env    string
+		auto   bool
+		want   bool
+	}{
+		{"First lock", "U1", "time", "staging", false, true},
+		{"Different user same app", "U2", "time", "staging", false, false},
+		{"Different user deploying same app", "U2", "time", "staging", true, false},
+		{"Holder deploying their locked app", "U1", "time", "staging", true, true},
+		{"Different app", "U2", "sales", "staging", true, true},
+		{"Same user deploying twice", "U2", "sales", "staging", true, false},
+		{"Same app from another environment's channel", "U3", "sales", "production", true, false},
+	}
+
+	m := lock.NewManager()
+	for i, l := range tt {
+		t.Run(l.desc, func(t *testing.T) {
+			_, got := m.Acquire(l.app, l.env, l.holder, "", l.auto)
+			if got != l.want {
+				t.Errorf("Test %d: Acquire(%s,%s) got %v, want %v", i+1, l.app, l.holder, got, l.want)
+			}
+		})
+	}
+}
+
+func TestRelease(t *testing.T) {
+	m := lock.NewManager()
+	m.Acquire("time", "staging", "U1", "testing", false)
+
+	if _, ok := m.Release("time", "U2", false); ok {
+		t.Errorf("Release by non-holder succeeded")
+	}
+	m.ReleaseDeploy("time")
+	if m.Get("time") == nil {
+		t.Errorf("ReleaseDeploy released a manual lock")
+	}
+	if _, ok := m.Release("time", "U2", true); !ok {
+		t.Errorf("Forced release failed")
+	}
+	if m.Get("time") != nil {
+		t.Errorf("Lock still held after forced release")
+	}
+}
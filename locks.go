@@ -0,0 +1,88 @@
+package main
+
+import (
+	"deploy-bot/audit"
+	"deploy-bot/auth"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/util"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// doLock handles `@bot lock <app> [reason]`
+func (b *Bot) doLock(text, user string, connInfo slackbot.ConnInfo) {
+	args := strings.Split(text, " ")
+	if len(args) < 2 {
+		msg := fmt.Sprintf("_Usage: @%s lock <app> [reason]_", os.Getenv("SLACKBOT_NAME"))
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	app := args[1]
+	if util.CheckAppValid(app) != true {
+		msg := fmt.Sprintf("_私は認識しません, translation: I do not recognize %s app_", app)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if !b.authorize(user, app, auth.Deployer, connInfo) {
+		return
+	}
+	reason := strings.Join(args[2:], " ")
+	env := util.GetEnvironment(connInfo.Channel)
+
+	l, ok := b.Locks.Acquire(app, env, user, reason, false)
+	outcome := "locked"
+	if !ok {
+		outcome = "already locked by " + l.Holder
+	}
+	b.auditEvent(audit.Entry{Actor: user, Action: "lock", Channel: connInfo.Channel, App: app, Env: env, Outcome: outcome, Detail: reason})
+	if !ok {
+		msg := fmt.Sprintf("_%s_", l)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	msg := fmt.Sprintf("_🔒 %s_", l)
+	b.Slack.SendMessage(connInfo, msg)
+}
+
+// doUnlock handles `@bot unlock <app>`; admins may release locks held by anyone
+func (b *Bot) doUnlock(text, user string, connInfo slackbot.ConnInfo) {
+	args := strings.Split(text, " ")
+	if len(args) != 2 {
+		msg := fmt.Sprintf("_Usage: @%s unlock <app>_", os.Getenv("SLACKBOT_NAME"))
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	app := args[1]
+	if !b.authorize(user, app, auth.Deployer, connInfo) {
+		return
+	}
+	env := util.GetEnvironment(connInfo.Channel)
+
+	admin := b.Authz.Can(user, app, env, auth.Admin)
+	l, ok := b.Locks.Release(app, user, admin)
+	if l != nil {
+		outcome := "unlocked"
+		switch {
+		case !ok:
+			outcome = "denied, locked by " + l.Holder
+		case l.Holder != user:
+			outcome = "overrode lock held by " + l.Holder
+		}
+		b.auditEvent(audit.Entry{Actor: user, Action: "unlock", Channel: connInfo.Channel, App: app, Env: env, Outcome: outcome})
+	}
+	switch {
+	case l == nil:
+		msg := fmt.Sprintf("_`%s` is not locked_", app)
+		b.Slack.SendMessage(connInfo, msg)
+	case !ok:
+		msg := fmt.Sprintf("_%s; only they or an admin can unlock it_", l)
+		b.Slack.SendMessage(connInfo, msg)
+	case l.Holder != user:
+		msg := fmt.Sprintf("_🔓 <@%s> overrode the lock on `%s` held by <@%s> for %s_", user, app, l.Holder, l.Age())
+		b.Slack.SendMessage(connInfo, msg)
+	default:
+		msg := fmt.Sprintf("_🔓 `%s` unlocked_", app)
+		b.Slack.SendMessage(connInfo, msg)
+	}
+}
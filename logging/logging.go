@@ -0,0 +1,241 @@
+// Package logging writes one JSON object per line, with a level and whatever fields the
+// caller attached, such as the deploy a line belongs to. Anything that looks like a
+// credential is redacted on the way out
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel accepts debug, info, warn or error, defaulting to info
+func ParseLevel(s string) Level {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i)
+		}
+	}
+	return Info
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes lines carrying its fields. The zero value is not usable, start from
+// the package functions or New
+type Logger struct {
+	out    *output
+	fields []field
+}
+
+// output is shared by a logger and everything derived from it with With
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	now   func() time.Time
+}
+
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w, level: level, now: time.Now}}
+}
+
+// std is configured from LOG_LEVEL and writes to stderr
+var std = New(os.Stderr, ParseLevel(os.Getenv("LOG_LEVEL")))
+
+// Default returns the logger the package functions write to
+func Default() *Logger {
+	return std
+}
+
+// SetLevel changes the verbosity of l and every logger derived from it
+func (l *Logger) SetLevel(level Level) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.level = level
+}
+
+// With returns a logger that adds the key/value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+len(kv)/2)
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields = append(fields, field{fmt.Sprint(kv[i]), kv[i+1]})
+	}
+	return &Logger{out: l.out, fields: fields}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.log(Debug, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.log(Info, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.log(Warn, format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.log(Error, format, args...) }
+
+// Fatalf logs at error and exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(Error, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	if level < l.out.level {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeValue(&b, l.out.now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeValue(&b, level.String())
+	b.WriteString(`,"msg":`)
+	writeValue(&b, fmt.Sprintf(format, args...))
+	for _, f := range l.fields {
+		b.WriteByte(',')
+		writeValue(&b, f.key)
+		b.WriteByte(':')
+		if sensitiveKey(f.key) {
+			writeValue(&b, redacted)
+			continue
+		}
+		writeValue(&b, f.value)
+	}
+	b.WriteString("}\n")
+	l.out.w.Write(b.Bytes())
+}
+
+func writeValue(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		b.Write(marshal(Redact(v)))
+		return
+	case error:
+		writeValue(b, v.Error())
+		return
+	case fmt.Stringer:
+		writeValue(b, v.String())
+		return
+	}
+	data := marshal(v)
+	if data == nil {
+		data = marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// marshal leaves <, > and & alone, they're all over Slack-formatted messages
+func marshal(v interface{}) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil
+	}
+	return bytes.TrimRight(b.Bytes(), "\n")
+}
+
+func Debugf(format string, args ...interface{}) { std.log(Debug, format, args...) }
+func Infof(format string, args ...interface{})  { std.log(Info, format, args...) }
+func Warnf(format string, args ...interface{})  { std.log(Warn, format, args...) }
+func Errorf(format string, args ...interface{}) { std.log(Error, format, args...) }
+func Fatalf(format string, args ...interface{}) { std.Fatalf(format, args...) }
+
+// With returns a logger that adds the key/value pairs to every line
+func With(kv ...interface{}) *Logger {
+	return std.With(kv...)
+}
+
+type ctxKey struct{}
+
+// NewContext carries l to everything ctx is passed to, e.g. every stage of a deploy
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return std
+}
+
+// Writer adapts l for the standard library's log package, logging each line at level
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		l.log(level, "%s", strings.TrimRight(string(p), "\n"))
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+const redacted = "[REDACTED]"
+
+// Credentials that turn up in messages: Slack, GitHub and AWS tokens, and bearer tokens
+var secretPatterns = regexp.MustCompile(`xox[abpors]-[A-Za-z0-9-]+|xapp-[A-Za-z0-9-]+|gh[pousr]_[A-Za-z0-9]{20,}|github_pat_[A-Za-z0-9_]{20,}|AKIA[0-9A-Z]{16}|(?i:bearer\s+)[A-Za-z0-9._~+/=-]+`)
+
+// Redact replaces anything in s that looks like a token
+func Redact(s string) string {
+	return secretPatterns.ReplaceAllStringFunc(s, func(m string) string {
+		if strings.HasPrefix(strings.ToLower(m), "bearer") {
+			return "Bearer " + redacted
+		}
+		return redacted
+	})
+}
+
+// Keys whose values are never logged, whether fields or headers
+var sensitiveKeys = []string{"token", "secret", "password", "authorization", "signature", "cookie", "jwt"}
+
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers returns h for logging, with signatures, tokens and the like redacted
+func Headers(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, v := range h {
+		if sensitiveKey(k) {
+			m[k] = redacted
+			continue
+		}
+		m[k] = strings.Join(v, ", ")
+	}
+	return m
+}
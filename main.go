@@ -2,10 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"deploy-bot/argo"
+	"deploy-bot/audit"
+	"deploy-bot/auth"
 	"deploy-bot/aws"
+	"deploy-bot/config"
+	"deploy-bot/freeze"
 	"deploy-bot/github"
+	"deploy-bot/health"
+	"deploy-bot/logging"
+	"deploy-bot/metrics"
+	"deploy-bot/pipeline"
 	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"deploy-bot/tracing"
 	"deploy-bot/util"
 	"encoding/json"
 	"fmt"
@@ -13,135 +24,210 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	//"time"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Bad global var that can be read between handlers to enable threaded Slack responses
-var slackEventTimestamp = "thisIsAHugeAntiPattern"
-var slackEventChannel = "C02MYKCQG9W"
-
-func doEvent(event *slackevents.AppMentionEvent, connInfo slackbot.ConnInfo) {
-	log.Printf("Event received: %s", event.Text)
-	// TODO: Implement additional contexts for subsequent requests
-	ctx, ghc := github.Client()
-	valid, msg, app, ref := util.CheckArgsValid(event.Text)
-	if valid != true {
-		slackbot.SendMessage(connInfo, msg)
-		return
+func (b *Bot) doEvent(event *slackevents.AppMentionEvent, connInfo slackbot.ConnInfo) {
+	logging.With("user", event.User, "channel", event.Channel).Infof("Event received: %s", event.Text)
+	b.auditEvent(audit.Entry{Actor: event.User, Action: "mention", Channel: event.Channel, Outcome: "received", Detail: event.Text})
+	cmd, text := util.SplitCommand(event.Text)
+	switch cmd {
+	case "plan":
+		b.doPlan(text, event.User, connInfo)
+	case "lock":
+		b.doLock(text, event.User, connInfo)
+	case "unlock":
+		b.doUnlock(text, event.User, connInfo)
+	case "queue":
+		b.doQueue(event.User, connInfo)
+	case "cancel":
+		b.doCancel(text, event.User, connInfo)
+	case "history":
+		b.doHistory(text, event.User, connInfo)
+	case "freeze":
+		b.doFreeze(text, event.User, connInfo)
+	case "unfreeze":
+		b.doUnfreeze(text, event.User, connInfo)
+	case "freezes":
+		b.doFreezes(event.User, connInfo)
+	case "override":
+		b.doOverride(text, event.User, connInfo)
+	default:
+		b.enqueueDeploy(text, event.User, "", connInfo)
 	}
-	prNum, _ := strconv.Atoi(ref)
-	pr, resp, err := github.GetPullRequest(ctx, ghc, app, prNum)
+}
 
-	if resp.StatusCode == 200 { // A known PR was provided
-		msg := fmt.Sprintf("_Fetching %v _", pr.GetHTMLURL())
-		slackbot.SendMessage(connInfo, msg)
-	} else if resp.StatusCode == 404 && ref != "main" { // Non-main branch was provided
-		msg := fmt.Sprintf("_Error: %s_", err)
-		slackbot.SendMessage(connInfo, msg)
+// doHook forwards the githook to Argo and lets the deploy that pushed the commit
+// carry on to its sync stage
+func (b *Bot) doHook(body []byte) {
+	//TODO: Have Adam create unique GH user with PAT that can be used to identify as Slackbot user
+	app, err := util.GetAppFromPayload(body)
+	if err != nil {
+		logging.Errorf("Error parsing app from git webhook payload: %s", err.Error())
 		return
-	} else { // Main branch was provided
-		msg := fmt.Sprintf("_Fetching `%s` for %s _", ref, app)
-		slackbot.SendMessage(connInfo, msg)
 	}
-
-	tagExists, imgTag, sha := aws.ConfirmImageExists(ctx, ghc, pr, app)
-	if tagExists != true {
-		msg := fmt.Sprintf("_`%s` does not exist in ECR_", imgTag)
-		slackbot.SendMessage(connInfo, msg)
-		return
+	v, waiting := b.hookWaiters.Load(app)
+	if !waiting {
+		logging.Infof("No deploy of %s is waiting on this githook, forwarding it anyway", app)
 	}
 
-	completed := github.ConfirmChecksCompleted(ctx, ghc, app, sha, nil)
-	if completed != true {
-		msg := fmt.Sprintf("`_%s` has not been promoted to ECR; Github Actions are still underway_", imgTag)
-		slackbot.SendMessage(connInfo, msg)
-		return
+	//if err := argo.HardRefresh(argoc); err != nil {
+	//	//log.Printf("Error refreshing Argo application: %s", err.Error())
+	//}
+	ctx := b.ctx
+	if waiting {
+		ctx = trace.ContextWithSpanContext(ctx, v.(*hookWaiter).span)
+	}
+	payload := bytes.NewReader(body)
+	msg, err := b.CD.ForwardGitshot(ctx, payload)
+	if err != nil {
+		logging.Errorf("Error forwarding gitshot to Argocd: %s", err.Error())
+	}
+	if waiting {
+		w := v.(*hookWaiter)
+		w.notify(msg)
+		w.arrive()
 	}
+}
 
-	rc, repoContent, dlMsg, err := github.DownloadValues(ctx, ghc, app)
+func main() {
+	// TODO: Remove this when all testing is complete
+	godotenv.Load(".env")
+	logging.Default().SetLevel(logging.ParseLevel(os.Getenv("LOG_LEVEL"))) // May have come from .env
+	// Libraries that use the standard logger end up in the JSON log too
+	log.SetFlags(0)
+	log.SetOutput(logging.Default().Writer(logging.Info))
+	shutdownTracing, err := tracing.Init(context.Background())
 	if err != nil {
-		msg := fmt.Sprintf("_Error %s_", err.Error())
-		slackbot.SendMessage(connInfo, msg)
+		logging.Fatalf("Error setting up tracing: %s", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		auditCommand(os.Args[2:])
 		return
-	} else {
-		slackbot.SendMessage(connInfo, dlMsg)
+	}
+	auditLog := openAuditLog()
+	defer auditLog.Close()
+	dbPath := os.Getenv("DEPLOY_DB")
+	if dbPath == "" {
+		dbPath = "deploy-bot.db"
+	}
+	history, err := store.Open(dbPath)
+	if err != nil {
+		logging.Fatalf("Error opening deploy history %s: %s", dbPath, err)
+	}
+	defer history.Close()
+	// An empty config would mean no RBAC grants, falling back to the legacy roles
+	if err := config.Err(); err != nil {
+		logging.Fatalf("Error loading config: %s", err)
+	}
+	if err := freeze.Validate(config.Get().Freezes, util.Environments()); err != nil {
+		logging.Fatalf("Error in config: %s", err)
+	}
+	authz, err := auth.New(config.Get().RBAC.Grants, slackbot.Client().GetUserGroupMembers)
+	if err != nil {
+		logging.Fatalf("Error in config: %s", err)
 	}
 
-	values, _, msg := github.UpdateValues(rc, imgTag)
-	if msg != "" {
-		slackbot.SendMessage(connInfo, msg)
-		return
+	repos, registry := github.NewRepos(), aws.NewECR()
+	cd, err := argo.New(config.Get().Argo)
+	if err != nil {
+		logging.Fatalf("Error setting up the Argo CD client: %s", err)
 	}
+	b := NewBot(Services{
+		Repo:     repos,
+		Registry: registry,
+		GitOps:   repos,
+		CD:       cd,
+		Slack:    slackbot.Messenger{},
+	}, history, authz)
+	b.Audit = auditLog
 
-	// This triggers Github webhook with request inbound for /githook
-	if github.PushCommit(ctx, ghc, app, imgTag, values, repoContent); err != nil {
-		msg := fmt.Sprintf("_Error %s_", err.Error())
-		slackbot.SendMessage(connInfo, msg)
-		return
+	b.resumeDeploys()
+	http.HandleFunc("/history", b.historyHandler)
+	http.HandleFunc("/githook", b.gitHook)
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/healthz", health.Alive)
+	http.HandleFunc("/readyz", readiness(repos, registry, cd).Ready)
+	if os.Getenv("SLACK_SOCKET_MODE") == "true" {
+		go b.runSocketMode()
 	} else {
-		deployMsg := fmt.Sprintf("_Updating image.tag to `%s`_", imgTag)
-		slackbot.SendMessage(connInfo, deployMsg)
+		http.HandleFunc("/slackevent", b.slackEvent)
+		http.HandleFunc("/slackinteraction", b.slackInteraction)
 	}
-}
+	s := &http.Server{
+		Addr: fmt.Sprintf(":%s", os.Getenv("PORT")),
+	}
+	logging.Infof("Server listening on localhost:%s", os.Getenv("PORT"))
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logging.Fatalf("Error serving HTTP: %s", err)
+		}
+	}()
 
-func doHook(body []byte, connInfo slackbot.ConnInfo) {
-	//TODO: Have Adam create unique GH user with PAT that can be used to identify as Slackbot user
-	app, err := util.GetAppFromPayload(body)
-	if err != nil {
-		log.Printf("Error parsing app from git webhook payload: %s", err.Error())
-		msg := fmt.Sprintf("_Error parsing app from git webhook payload: %s_", err.Error())
-		slackbot.SendMessage(connInfo, msg)
-		return
+	// Keep serving while draining, so mentions get told to retry and githooks still arrive
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	logging.Infof("Received %s", <-stop)
+	b.Shutdown(gracePeriod())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		logging.Errorf("Error shutting down HTTP server: %s", err)
 	}
-	argoc := argo.Client()
-	//if err := argo.HardRefresh(argoc); err != nil {
-	//	//log.Printf("Error refreshing Argo application: %s", err.Error())
-	//}
-	payload := bytes.NewReader(body)
-	if msg, err := argo.ForwardGitshot(argoc, payload); err != nil {
-		log.Printf("Error forwarding gitshot to Argocd: %s", err.Error())
-		slackbot.SendMessage(connInfo, msg)
-		return
+	slackbot.Flush()
+	if err := shutdownTracing(ctx); err != nil {
+		logging.Errorf("Error flushing traces: %s", err)
 	}
+	logging.Infof("Shutdown complete")
+}
 
-	if msg, err := argo.SyncApplication(argoc, app); err != nil {
-		log.Printf("Error syncing application in Argocd: %s", err.Error())
-		slackbot.SendMessage(connInfo, msg)
-		return
-	} else {
-		go argo.DoStatusLoop(argoc, app, connInfo)
-		slackbot.SendMessage(connInfo, msg) //comment if desired "Argocd application Sync underway"
+// readiness checks everything a deploy depends on, caching results for READY_CACHE_TTL (default 30s)
+func readiness(repos *github.Repos, registry *aws.ECR, cd *argo.Controller) *health.Checker {
+	ttl, err := time.ParseDuration(os.Getenv("READY_CACHE_TTL"))
+	if err != nil || ttl < 0 {
+		ttl = 30 * time.Second
 	}
+	c := health.New(ttl, 5*time.Second)
+	c.Add("config", checkConfig)
+	c.Add("github", repos.Check)
+	c.Add("ecr", registry.Check)
+	c.Add("argo", cd.Check)
+	c.Add("slack", slackbot.AuthTest)
+	return c
 }
 
-func main() {
-	// TODO: Remove this when all testing is complete
-	godotenv.Load(".env")
-	http.HandleFunc("/githook", gitHook)
-	http.HandleFunc("/slackevent", slackEvent)
-	s := &http.Server{
-		Addr: fmt.Sprintf(":%s", os.Getenv("PORT")),
+// checkConfig fails when the config file is unreadable or an app's pipeline can't be built from it
+func checkConfig(context.Context) error {
+	if err := config.Err(); err != nil {
+		return err
+	}
+	if err := freeze.Validate(config.Get().Freezes, util.Environments()); err != nil {
+		return err
 	}
-	log.Printf("[INFO] Server listening on localhost:%s", os.Getenv("PORT"))
-	s.ListenAndServe()
+	for app := range config.Get().Pipelines {
+		if _, err := pipeline.ForApp(app); err != nil {
+			return fmt.Errorf("pipeline for %s: %w", app, err)
+		}
+	}
+	return nil
 }
 
-func gitHook(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Githook received: %v", r)
+func (b *Bot) gitHook(w http.ResponseWriter, r *http.Request) {
+	l := logging.With("delivery", r.Header.Get("X-GitHub-Delivery"), "event", r.Header.Get("X-GitHub-Event"))
+	l.Infof("Githook received from %s", r.RemoteAddr)
+	l.With("headers", logging.Headers(r.Header)).Debugf("Githook headers")
 	body, _ := io.ReadAll(r.Body)
-	connInfo := slackbot.ConnInfo{
-		Client:    slackbot.Client(),
-		Channel:   slackEventChannel,
-		Timestamp: slackEventTimestamp,
-	}
 
 	if len(body) == 0 {
-		log.Printf("Could not read gitHook request body, body length: %d", len(body))
+		l.Errorf("Could not read gitHook request body, body length: %d", len(body))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	} else {
@@ -150,37 +236,52 @@ func gitHook(w http.ResponseWriter, r *http.Request) {
 
 		switch util.ConfirmCallerSlackbot(body) {
 		case true:
-			go doHook(body, connInfo)
+			// Counted even while shutting down, deploys in flight are waiting on it
+			b.inflight.add()
+			go func() {
+				defer b.inflight.done()
+				b.doHook(body)
+			}()
 		default:
-			log.Printf("Caller not Slackbot, returning...")
+			l.Infof("Githook not pushed by the bot, ignoring it")
 			return
 		}
 	}
 }
 
-func slackEvent(w http.ResponseWriter, r *http.Request) {
+// readSlackRequest reads the body of a request from Slack and verifies its signature,
+// writing an error status and returning false if it can't be trusted
+func readSlackRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
 	signingSecret := os.Getenv("SLACK_SIGNING_SECRET")
 	body, err := io.ReadAll(r.Body)
 
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	defer r.Body.Close()
 
 	sv, err := slack.NewSecretsVerifier(r.Header, signingSecret)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
 	if _, err := sv.Write(body); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
 	if err := sv.Ensure(); err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+func (b *Bot) slackEvent(w http.ResponseWriter, r *http.Request) {
+	body, ok := readSlackRequest(w, r)
+	if !ok {
 		return
 	}
 
@@ -201,34 +302,61 @@ func slackEvent(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(r.Challenge))
 	}
 
-	innerEvent := event.InnerEvent
 	if event.Type == slackevents.CallbackEvent {
+		// Ack first: Slack retries anything not answered within 3 seconds,
+		// so all the work happens after the response has gone
 		w.Header().Set("X-Slack-No-Retry", os.Getenv("SLACK_NO_RETRY"))
+		w.WriteHeader(http.StatusOK)
 
-		switch e := innerEvent.Data.(type) {
-		case *slackevents.AppMentionEvent:
-			connInfo := slackbot.ConnInfo{
-				Client:    slackbot.Client(),
-				Channel:   e.Channel,
-				Timestamp: e.TimeStamp, // Required for threaded responses
-			}
-			// Modifying a global variable like this huge-anti pattern,
-			// but it's the only solution I have for now that solves the problem
-			// of passing the original slackEvent timestamp to the the githook handler
-			slackEventTimestamp = e.TimeStamp
-			slackEventChannel = e.Channel
-			if e.Channel == os.Getenv("PROTECTED_CHANNEL") { // If the channel is deployments-production
-				authorized := util.AuthorizeUser(e.User)
-				if authorized != true {
-					msg := fmt.Sprintf("_あなたはふさわしくない_")
-					slackbot.SendMessage(connInfo, msg)
-					return
-				}
-			}
-			go doEvent(e, connInfo)
+		retry, _ := strconv.Atoi(r.Header.Get("X-Slack-Retry-Num"))
+		b.dispatchEvent(event, retry, r.Header.Get("X-Slack-Retry-Reason"))
+	}
+}
 
-		default:
+// dispatchEvent handles a callback event from either transport once it has been acked.
+// retry is Slack's count of previous attempts to deliver it
+func (b *Bot) dispatchEvent(event slackevents.EventsAPIEvent, retry int, reason string) {
+	eventID := ""
+	if cb, ok := event.Data.(*slackevents.EventsAPICallbackEvent); ok {
+		eventID = cb.EventID
+	}
+	if retry > 0 {
+		logging.Infof("Slack retry %d of event %s: %s", retry, eventID, reason)
+	}
+	if !b.events.First(eventID) {
+		logging.Infof("Dropping duplicate event %s", eventID)
+		return
+	}
+
+	switch e := event.InnerEvent.Data.(type) {
+	case *slackevents.AppMentionEvent:
+		connInfo := slackbot.ConnInfo{
+			Client:    slackbot.Client(),
+			Channel:   e.Channel,
+			Timestamp: e.TimeStamp, // Required for threaded responses
+		}
+		if retry > 0 && b.handledMention(e) {
+			logging.Infof("Dropping retried event %s, mention %s/%s was already handled", eventID, e.Channel, e.TimeStamp)
+			return
+		}
+		if !b.inflight.admit() {
+			b.Slack.SendMessage(connInfo, "_I'm restarting, please retry shortly_")
 			return
 		}
+		go func() {
+			defer b.inflight.done()
+			b.doEvent(e, connInfo)
+		}()
+	}
+}
+
+// handledMention checks the deploy history for a deploy already requested by the mention,
+// which catches retries of events received before the bot restarted
+func (b *Bot) handledMention(e *slackevents.AppMentionEvent) bool {
+	d, err := b.History.ByThread(e.Channel, e.TimeStamp)
+	if err != nil {
+		logging.Errorf("Error checking history for mention %s/%s: %s", e.Channel, e.TimeStamp, err)
+		return false
 	}
+	return d != nil
 }
@@ -0,0 +1,82 @@
+// Package metrics holds the Prometheus metrics served at /metrics
+package metrics
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "deploybot"
+
+var (
+	// Deploys counts finished deploys by app, environment and Outcome
+	Deploys = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deploys_total",
+		Help:      "Deploys finished, by app, environment and result.",
+	}, []string{"app", "env", "result"})
+
+	// StageDuration times each pipeline stage, e.g. verify-image for the ECR lookup
+	// and commit for the gitops push. Stages can wait on people or Argo, hence the long tail
+	StageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stage_duration_seconds",
+		Help:      "How long each deploy pipeline stage took, by app, stage and whether it failed.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+	}, []string{"app", "stage", "failed"})
+
+	// ArgoSyncs counts how watched syncs ended: Synced, Degraded, Sync timeout and so on
+	ArgoSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "argo_syncs_total",
+		Help:      "Argo CD syncs watched to the end, by app and result.",
+	}, []string{"app", "result"})
+
+	// APIErrors counts failed calls to the services the bot depends on
+	APIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Failed calls to Slack, GitHub, ECR and Argo CD, by service and operation.",
+	}, []string{"service", "operation"})
+
+	RunningDeploys = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "running_deploys",
+		Help:      "Deploys currently running their pipeline.",
+	})
+)
+
+// APIError counts a failed call to service, doing nothing when err is nil so callers
+// can pass whatever error they got back
+func APIError(service, operation string, err error) {
+	if err != nil {
+		APIErrors.WithLabelValues(service, operation).Inc()
+	}
+}
+
+// Outcome reduces a deploy's recorded result, such as "failed: watch: Sync timeout", to the
+// handful of values the deploys counter is labelled with
+func Outcome(result string) string {
+	switch {
+	case result == "Synced":
+		return "success"
+	case strings.HasPrefix(result, "cancelled"):
+		return "cancelled"
+	case strings.HasPrefix(result, "abandoned"):
+		return "abandoned"
+	case result == "failed: frozen":
+		return "frozen"
+	case result == "failed: locked":
+		return "locked"
+	default:
+		return "failed"
+	}
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
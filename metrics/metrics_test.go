@@ -0,0 +1,28 @@
+package metrics_test
+
+import (
+	"deploy-bot/metrics"
+	"testing"
+)
+
+func TestOutcome(t *testing.T) {
+	tt := []struct {
+		result string
+		want   string
+	}{
+		{"Synced", "success"},
+		{"failed: watch: Sync timeout", "failed"},
+		{"failed: verify-image: `main-0123456` does not exist in ECR", "failed"},
+		{"failed: frozen", "frozen"},
+		{"failed: locked", "locked"},
+		{"cancelled by <@U1>", "cancelled"},
+		{"abandoned: bot restarted", "abandoned"},
+	}
+	for i, v := range tt {
+		t.Run(v.result, func(t *testing.T) {
+			if got := metrics.Outcome(v.result); got != v.want {
+				t.Errorf("Test %d: Outcome(%s) got %s, want %s", i+1, v.result, got, v.want)
+			}
+		})
+	}
+}
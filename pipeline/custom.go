@@ -0,0 +1,110 @@
+package pipeline
+
+import (
+	"bytes"
+	"deploy-bot/config"
+	"deploy-bot/tracing"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// StageFactory builds a custom stage from its config
+type StageFactory func(sc config.StageConfig) (Stage, error)
+
+var stageTypes = map[string]StageFactory{
+	"webhook": newWebhook,
+}
+
+// RegisterStageType makes a custom stage type available to the pipelines in config
+func RegisterStageType(typ string, factory StageFactory) {
+	stageTypes[typ] = factory
+}
+
+func buildStage(sc config.StageConfig) (Stage, error) {
+	if sc.Name == "" {
+		return nil, fmt.Errorf("custom stage of type %q has no name", sc.Type)
+	}
+	if (sc.Before == "") == (sc.After == "") {
+		return nil, fmt.Errorf("stage %s: exactly one of before or after must be set", sc.Name)
+	}
+	factory, ok := stageTypes[sc.Type]
+	if !ok {
+		return nil, fmt.Errorf("stage %s: unknown type %q", sc.Name, sc.Type)
+	}
+	return factory(sc)
+}
+
+// webhook POSTs the deploy to a URL and fails the deploy unless it gets a 2xx back,
+// which covers smoke tests, change-ticket checks and the like. The response body
+// is shown in Slack when the webhook rejects the deploy
+type webhook struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newWebhook(sc config.StageConfig) (Stage, error) {
+	if sc.URL == "" {
+		return nil, fmt.Errorf("stage %s: webhook stages need a url", sc.Name)
+	}
+	timeout := 30 * time.Second
+	if sc.Timeout > 0 {
+		timeout = time.Duration(sc.Timeout) * time.Second
+	}
+	w := &webhook{
+		name:    sc.Name,
+		url:     sc.URL,
+		headers: sc.Headers,
+		client:  &http.Client{Timeout: timeout, Transport: tracing.Transport("webhook", http.DefaultTransport)},
+	}
+	return w, nil
+}
+
+func (w *webhook) Name() string { return w.name }
+
+// Reads only App, the webhook gets whatever else earlier stages have filled in
+func (w *webhook) Reads() []string { return []string{"App"} }
+func (w *webhook) Fills() []string { return nil }
+
+func (w *webhook) Run(s *State) error {
+	payload, _ := json.Marshal(map[string]string{
+		"stage":         w.name,
+		"app":           s.App,
+		"environment":   s.Env,
+		"ref":           s.Ref,
+		"sha":           s.SHA,
+		"image_tag":     s.ImageTag,
+		"gitops_commit": s.GitopsCommit,
+		"requester":     s.User,
+	})
+	req, err := http.NewRequestWithContext(s.Ctx, "POST", w.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, os.ExpandEnv(v)) // Keeps tokens out of the config file
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return &StageError{Msg: fmt.Sprintf("_`%s` failed: %s_", w.name, err), Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		msg := fmt.Sprintf("_`%s` rejected the deploy (%s)_", w.name, resp.Status)
+		if b := strings.TrimSpace(string(body)); b != "" {
+			msg += fmt.Sprintf("\n```%s```", b)
+		}
+		return fail(msg)
+	}
+	s.notify(fmt.Sprintf("_`%s` passed_", w.name))
+	return nil
+}
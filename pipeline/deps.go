@@ -0,0 +1,48 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+
+	"github.com/google/go-github/v40/github"
+)
+
+// The services a deploy talks to. Each is as narrow as the stages need, so tests can
+// swap in the in-memory fakes from internal/fakes for the real GitHub, ECR and Argo CD
+
+// SourceRepo is the GitHub repo an app is built from, named after the app
+type SourceRepo interface {
+	// PullRequest returns nil without an error when there is no such PR
+	PullRequest(ctx context.Context, app string, number int) (*github.PullRequest, error)
+	HeadCommit(ctx context.Context, app, branch string) (string, error)
+	// ChecksCompleted reports whether the image for sha has been promoted to ECR
+	ChecksCompleted(ctx context.Context, app, sha string) bool
+	CreateDeployment(ctx context.Context, app, sha, env, desc string) (int64, error)
+	SetDeploymentStatus(ctx context.Context, app string, id int64, state, desc, logURL, envURL string) error
+	CommentOnPR(ctx context.Context, app string, number int, body string) error
+}
+
+// ImageRegistry holds the images the apps are deployed from
+type ImageRegistry interface {
+	ImageExists(ctx context.Context, app, tag string) (bool, error)
+}
+
+// GitOpsStore is the repo of values files Argo CD deploys from
+type GitOpsStore interface {
+	DownloadValues(ctx context.Context, app string) (io.ReadCloser, *github.RepositoryContent, error)
+	// PushValues commits new values for the app, returning the commit SHA
+	PushValues(ctx context.Context, app, imgTag string, values []byte, content *github.RepositoryContent) (string, error)
+	CurrentImageTag(ctx context.Context, app string) (string, error)
+}
+
+// CDController syncs the apps from the gitops repo
+type CDController interface {
+	ForwardGitshot(ctx context.Context, payload io.Reader) (string, error)
+	Sync(ctx context.Context, app string) (string, error)
+	// Diff lists resources whose live state already differs from git: current drift,
+	// not the effect of the values a deploy would commit
+	Diff(ctx context.Context, app string) ([]string, string, error)
+	// WatchSync reports progress to notify until the app is Synced, it gives up or ctx is done,
+	// returning the result
+	WatchSync(ctx context.Context, app string, notify func(msg string)) string
+}
@@ -0,0 +1,372 @@
+package pipeline
+
+import (
+	"context"
+	"deploy-bot/config"
+	"deploy-bot/logging"
+	"deploy-bot/tracing"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v40/github"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Built-in stage names, in the order they run
+const (
+	StageValidate     = "validate"
+	StageResolveRef   = "resolve-ref"
+	StageVerifyImage  = "verify-image"
+	StageVerifyChecks = "verify-checks"
+	StageRenderValues = "render-values"
+	StageApprove      = "approve"
+	StageCommit       = "commit"
+	StageSync         = "sync"
+	StageWatch        = "watch"
+)
+
+// State is threaded through every stage. Each stage documents which fields it
+// reads and which it fills in for the stages after it
+type State struct {
+	// Set by the caller. Stages see a context bounded by their own timeout
+	Ctx      context.Context
+	Repo     SourceRepo
+	Registry ImageRegistry
+	GitOps   GitOpsStore
+	CD       CDController
+	Text     string // The mention, e.g. "<@bot> time 18"
+	User     string
+	Env      string
+	Notify   func(msg string)
+	Hook     <-chan struct{} // Closed when the githook for the commit reaches the bot
+	// Approve blocks until somebody else approves the deploy, nil when no approval is needed
+	Approve func(s *State) error
+
+	// Filled in by the stages
+	App          string
+	Ref          string
+	PR           *github.PullRequest
+	SHA          string
+	ImageTag     string
+	RepoContent  *github.RepositoryContent
+	OldValues    string
+	NewValues    []byte
+	GitopsCommit string
+	Result       string
+
+	Timings []Timing
+}
+
+type Timing struct {
+	Stage    string
+	Duration time.Duration
+}
+
+// TimingSummary formats the stage timings for Slack, e.g. "validate 0s, resolve-ref 1.2s"
+func (s *State) TimingSummary() string {
+	parts := make([]string, len(s.Timings))
+	for i, t := range s.Timings {
+		parts[i] = fmt.Sprintf("%s %s", t.Stage, t.Duration.Round(100*time.Millisecond))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s *State) notify(msg string) {
+	if s.Notify != nil {
+		s.Notify(msg)
+	}
+}
+
+// StageError is the error every stage failure is reported as
+type StageError struct {
+	Stage string
+	Msg   string // Slack-formatted explanation
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Stage, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Stage, strings.Trim(e.Msg, "_"))
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// AsStageError returns the StageError in err's chain, or treats err as a failure of stage
+// so callers can report any error the same way
+func AsStageError(err error, stage string) *StageError {
+	var se *StageError
+	if errors.As(err, &se) {
+		return se
+	}
+	return &StageError{Stage: stage, Msg: fmt.Sprintf("_Error %s_", err), Err: err}
+}
+
+type Stage interface {
+	Name() string
+	Run(s *State) error
+}
+
+// Flow is implemented by stages that say which State fields they read and fill, by field
+// name. FromConfig checks each field a stage reads is an input or is filled by a stage
+// before it, so a custom stage can't be placed ahead of what it needs
+type Flow interface {
+	Reads() []string
+	Fills() []string
+}
+
+// Inputs are the State fields set by whoever runs the pipeline rather than by its stages
+var Inputs = []string{"Text", "User", "Env", "Notify", "Hook", "Approve"}
+
+// DefaultTimeouts bound each built-in stage. Approval has its own expiry, and the
+// deploy timeout bounds every stage whether or not it has one here
+var DefaultTimeouts = map[string]time.Duration{
+	StageResolveRef:   time.Minute,
+	StageVerifyImage:  time.Minute,
+	StageVerifyChecks: time.Minute,
+	StageRenderValues: time.Minute,
+	StageCommit:       time.Minute,
+	StageSync:         HookTimeout + time.Minute,
+	StageWatch:        10 * time.Minute,
+}
+
+type Pipeline struct {
+	stages []Stage
+	// Timeouts for stages by name, stages without one only stop with the deploy
+	Timeouts map[string]time.Duration
+	// OnStage is called as each stage starts, e.g. to persist progress
+	OnStage func(stage string)
+	// AfterStage is called as each stage finishes, with its error if it failed
+	AfterStage func(t Timing, err error)
+	// Names of the stages that came from config rather than the built-in ones
+	custom map[string]bool
+}
+
+func New(stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages, Timeouts: make(map[string]time.Duration), custom: make(map[string]bool)}
+}
+
+// Default returns the built-in deploy stages
+func Default() *Pipeline {
+	p := New(
+		validate{},
+		resolveRef{},
+		verifyImage{},
+		verifyChecks{},
+		renderValues{},
+		approve{},
+		commit{},
+		syncApp{},
+		watch{},
+	)
+	for stage, d := range DefaultTimeouts {
+		p.Timeouts[stage] = d
+	}
+	return p
+}
+
+// ForApp returns the default pipeline with the app's custom stages from config inserted
+// and the stage timeouts from config applied
+func ForApp(app string) (*Pipeline, error) {
+	return FromConfig(config.Get(), app)
+}
+
+// FromConfig is ForApp with the given config rather than the loaded one
+func FromConfig(c *config.Config, app string) (*Pipeline, error) {
+	p := Default()
+	for stage, secs := range c.Timeouts.Stages {
+		p.Timeouts[stage] = time.Duration(secs) * time.Second
+	}
+	for _, sc := range c.Pipelines[app] {
+		stage, err := buildStage(sc)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.Insert(stage, sc.Before, sc.After); err != nil {
+			return nil, err
+		}
+		p.custom[stage.Name()] = true
+	}
+	if err := p.CheckFlow(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// CheckFlow fails when a stage reads a State field that is neither an input nor filled
+// by an earlier stage, or names a field State doesn't have. Stages that don't implement
+// Flow aren't checked
+func (p *Pipeline) CheckFlow() error {
+	filled := make(map[string]bool)
+	for _, f := range Inputs {
+		filled[f] = true
+	}
+	for _, stage := range p.stages {
+		flow, ok := stage.(Flow)
+		if !ok {
+			continue
+		}
+		for _, f := range append(flow.Reads(), flow.Fills()...) {
+			if _, ok := reflect.TypeOf(State{}).FieldByName(f); !ok {
+				return fmt.Errorf("stage %s names %s, which State has no field for", stage.Name(), f)
+			}
+		}
+		for _, f := range flow.Reads() {
+			if !filled[f] {
+				return fmt.Errorf("stage %s reads %s before any stage fills it", stage.Name(), f)
+			}
+		}
+		for _, f := range flow.Fills() {
+			filled[f] = true
+		}
+	}
+	return nil
+}
+
+// Insert adds stage immediately before or after the named stage
+func (p *Pipeline) Insert(stage Stage, before, after string) error {
+	anchor, offset := before, 0
+	if after != "" {
+		anchor, offset = after, 1
+	}
+	for i, s := range p.stages {
+		if s.Name() == anchor {
+			i += offset
+			p.stages = append(p.stages[:i], append([]Stage{stage}, p.stages[i:]...)...)
+			return nil
+		}
+	}
+	return fmt.Errorf("stage %s: no stage named %q to insert it next to", stage.Name(), anchor)
+}
+
+// Until returns a pipeline of the stages that run before the named one
+func (p *Pipeline) Until(name string) *Pipeline {
+	for i, s := range p.stages {
+		if s.Name() == name {
+			return &Pipeline{stages: p.stages[:i:i], Timeouts: p.Timeouts, OnStage: p.OnStage, AfterStage: p.AfterStage, custom: p.custom}
+		}
+	}
+	return p
+}
+
+// WithoutCustom returns a pipeline of only the built-in stages, along with the names of
+// the custom ones it dropped. Plans use it, custom stages can reach external systems
+func (p *Pipeline) WithoutCustom() (*Pipeline, []string) {
+	q := &Pipeline{Timeouts: p.Timeouts, OnStage: p.OnStage, AfterStage: p.AfterStage, custom: make(map[string]bool)}
+	var dropped []string
+	for _, s := range p.stages {
+		if p.custom[s.Name()] {
+			dropped = append(dropped, s.Name())
+			continue
+		}
+		q.stages = append(q.stages, s)
+	}
+	return q, dropped
+}
+
+func (p *Pipeline) Names() []string {
+	names := make([]string, len(p.stages))
+	for i, s := range p.stages {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+func (p *Pipeline) Run(s *State) error {
+	return p.RunFrom(s, "")
+}
+
+// RunFrom runs the stages starting at the named one, or every stage if from is empty.
+// It stops at the first failure, which is always returned as a *StageError, or
+// before the next stage once s.Ctx is done
+func (p *Pipeline) RunFrom(s *State, from string) error {
+	if s.Ctx == nil {
+		s.Ctx = context.Background()
+	}
+	ctx := s.Ctx
+	defer func() { s.Ctx = ctx }()
+
+	started := from == ""
+	for _, stage := range p.stages {
+		if !started && stage.Name() != from {
+			continue
+		}
+		started = true
+		if err := ctx.Err(); err != nil {
+			return &StageError{Stage: stage.Name(), Msg: ctxMsg(stage.Name(), err, 0), Err: err}
+		}
+
+		if p.OnStage != nil {
+			p.OnStage(stage.Name())
+		}
+		timeout := p.Timeouts[stage.Name()]
+		stageCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			stageCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		log := logging.FromContext(ctx).With("stage", stage.Name())
+		stageCtx = logging.NewContext(stageCtx, log)
+		stageCtx, span := tracing.Tracer().Start(stageCtx, "stage "+stage.Name(), trace.WithAttributes(attribute.String("stage", stage.Name())))
+		s.Ctx = stageCtx
+		log.Debugf("Stage %s started", stage.Name())
+		start := time.Now()
+		err := stage.Run(s)
+		t := Timing{Stage: stage.Name(), Duration: time.Since(start)}
+		if err != nil {
+			log.With("duration_ms", t.Duration.Milliseconds()).Warnf("Stage %s failed: %s", stage.Name(), err)
+		} else {
+			log.With("duration_ms", t.Duration.Milliseconds()).Infof("Stage %s finished", stage.Name())
+		}
+		s.Timings = append(s.Timings, t)
+		ctxErr := stageCtx.Err()
+		cancel()
+		s.Ctx = ctx
+		if err != nil {
+			var se *StageError
+			if !errors.As(err, &se) {
+				se = &StageError{Msg: fmt.Sprintf("_Error %s_", err), Err: err}
+			}
+			if ctxErr != nil { // Whatever the stage said, it was because time ran out
+				se = &StageError{Msg: ctxMsg(stage.Name(), ctxErr, timeout), Err: ctxErr}
+				if ctx.Err() != nil {
+					se.Msg = ctxMsg(stage.Name(), ctx.Err(), 0)
+					se.Err = ctx.Err()
+				}
+			}
+			se.Stage = stage.Name()
+			tracing.End(span, se)
+			if p.AfterStage != nil {
+				p.AfterStage(t, se)
+			}
+			return se
+		}
+		span.End()
+		if p.AfterStage != nil {
+			p.AfterStage(t, nil)
+		}
+	}
+	if !started {
+		return &StageError{Stage: from, Msg: fmt.Sprintf("_No stage named `%s` to resume from_", from)}
+	}
+	return nil
+}
+
+// ctxMsg explains a stage stopped by its context: the deploy was cancelled, the deploy
+// ran out of time, or the stage ran out of its own timeout
+func ctxMsg(stage string, err error, timeout time.Duration) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return fmt.Sprintf("_Deploy cancelled during `%s`_", stage)
+	case timeout > 0:
+		return fmt.Sprintf("_`%s` timed out after %s_", stage, timeout)
+	default:
+		return fmt.Sprintf("_Deploy timed out during `%s`_", stage)
+	}
+}
@@ -0,0 +1,292 @@
+package pipeline_test
+
+import (
+	"context"
+	"deploy-bot/config"
+	"deploy-bot/pipeline"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// stage records that it ran and optionally fails
+type stage struct {
+	name string
+	err  error
+	ran  *[]string
+}
+
+func (s stage) Name() string { return s.name }
+
+func (s stage) Run(*pipeline.State) error {
+	*s.ran = append(*s.ran, s.name)
+	return s.err
+}
+
+func TestInsert(t *testing.T) {
+	var ran []string
+	tt := []struct {
+		desc   string
+		before string
+		after  string
+		want   []string
+		err    bool
+	}{
+		{"Before commit", pipeline.StageCommit, "", []string{"validate", "resolve-ref", "verify-image", "verify-checks", "render-values", "approve", "custom", "commit", "sync", "watch"}, false},
+		{"After watch", "", pipeline.StageWatch, []string{"validate", "resolve-ref", "verify-image", "verify-checks", "render-values", "approve", "commit", "sync", "watch", "custom"}, false},
+		{"Unknown anchor", "deploy", "", nil, true},
+	}
+	for i, c := range tt {
+		t.Run(c.desc, func(t *testing.T) {
+			p := pipeline.Default()
+			err := p.Insert(stage{name: "custom", ran: &ran}, c.before, c.after)
+			if (err != nil) != c.err {
+				t.Fatalf("Test %d: Insert() got error %v, want error %v", i+1, err, c.err)
+			}
+			if err == nil && !reflect.DeepEqual(p.Names(), c.want) {
+				t.Errorf("Test %d: Insert() got %v, want %v", i+1, p.Names(), c.want)
+			}
+		})
+	}
+}
+
+func TestRunFrom(t *testing.T) {
+	boom := errors.New("boom")
+	tt := []struct {
+		desc      string
+		from      string
+		wantRan   []string
+		wantStage string
+	}{
+		{"All stages until failure", "", []string{"a", "b"}, "b"},
+		{"Resume at c", "c", []string{"c", "d"}, ""},
+		{"Resume at unknown stage", "z", nil, "z"},
+	}
+	for i, c := range tt {
+		t.Run(c.desc, func(t *testing.T) {
+			var ran []string
+			p := pipeline.New(
+				stage{name: "a", ran: &ran},
+				stage{name: "b", err: boom, ran: &ran},
+				stage{name: "c", ran: &ran},
+				stage{name: "d", ran: &ran},
+			)
+			s := &pipeline.State{}
+			err := p.RunFrom(s, c.from)
+			if !reflect.DeepEqual(ran, c.wantRan) {
+				t.Errorf("Test %d: RunFrom(%s) ran %v, want %v", i+1, c.from, ran, c.wantRan)
+			}
+			if c.wantStage == "" {
+				if err != nil {
+					t.Errorf("Test %d: RunFrom(%s) got error %v", i+1, c.from, err)
+				}
+				if len(s.Timings) != len(c.wantRan) {
+					t.Errorf("Test %d: RunFrom(%s) got %d timings, want %d", i+1, c.from, len(s.Timings), len(c.wantRan))
+				}
+				return
+			}
+			var se *pipeline.StageError
+			if !errors.As(err, &se) || se.Stage != c.wantStage {
+				t.Errorf("Test %d: RunFrom(%s) got error %v, want a StageError from %s", i+1, c.from, err, c.wantStage)
+			}
+		})
+	}
+}
+
+func TestAsStageError(t *testing.T) {
+	boom := errors.New("boom")
+	se := &pipeline.StageError{Stage: "commit", Msg: "_Error boom_", Err: boom}
+	tt := []struct {
+		desc      string
+		err       error
+		wantStage string
+		wantMsg   string
+	}{
+		{"StageError", se, "commit", "_Error boom_"},
+		{"Wrapped StageError", fmt.Errorf("deploy: %w", se), "commit", "_Error boom_"},
+		{"Any other error", boom, "sync", "_Error boom_"},
+	}
+	for i, c := range tt {
+		t.Run(c.desc, func(t *testing.T) {
+			got := pipeline.AsStageError(c.err, "sync")
+			if got.Stage != c.wantStage || got.Msg != c.wantMsg || !errors.Is(got, boom) {
+				t.Errorf("Test %d: AsStageError(%v) got %+v, want stage %s and message %q", i+1, c.err, got, c.wantStage, c.wantMsg)
+			}
+		})
+	}
+}
+
+// waitStage blocks until its context is done
+type waitStage struct{ name string }
+
+func (w waitStage) Name() string { return w.name }
+
+func (w waitStage) Run(s *pipeline.State) error {
+	<-s.Ctx.Done()
+	return s.Ctx.Err()
+}
+
+func TestRunContext(t *testing.T) {
+	tt := []struct {
+		desc    string
+		timeout time.Duration // For the waiting stage
+		cancel  bool          // Cancel the whole run shortly after it starts
+		wantErr error
+		wantMsg string
+	}{
+		{"Stage timeout", 10 * time.Millisecond, false, context.DeadlineExceeded, "`wait` timed out after 10ms"},
+		{"Cancelled", 0, true, context.Canceled, "Deploy cancelled during `wait`"},
+	}
+	for i, c := range tt {
+		t.Run(c.desc, func(t *testing.T) {
+			var ran []string
+			p := pipeline.New(stage{name: "a", ran: &ran}, waitStage{name: "wait"}, stage{name: "c", ran: &ran})
+			p.Timeouts["wait"] = c.timeout
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if c.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			s := &pipeline.State{Ctx: ctx}
+			err := p.Run(s)
+			var se *pipeline.StageError
+			if !errors.As(err, &se) {
+				t.Fatalf("Test %d: Run() got error %v, want a StageError", i+1, err)
+			}
+			if se.Stage != "wait" || !errors.Is(err, c.wantErr) || !strings.Contains(se.Msg, c.wantMsg) {
+				t.Errorf("Test %d: Run() got error %v (%q), want %v from wait with %q", i+1, err, se.Msg, c.wantErr, c.wantMsg)
+			}
+			if !reflect.DeepEqual(ran, []string{"a"}) {
+				t.Errorf("Test %d: Run() ran %v, want [a]", i+1, ran)
+			}
+			if s.Ctx != ctx {
+				t.Errorf("Test %d: Run() left the stage's context in the state", i+1)
+			}
+		})
+	}
+}
+
+func TestRunTraced(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	ctx, deploy := otel.Tracer("test").Start(context.Background(), "deploy")
+	var ran []string
+	p := pipeline.New(stage{name: "a", ran: &ran}, stage{name: "b", err: errors.New("boom"), ran: &ran})
+	p.Run(&pipeline.State{Ctx: ctx})
+	deploy.End()
+
+	tt := []struct {
+		name   string
+		status codes.Code
+	}{
+		{"stage a", codes.Unset},
+		{"stage b", codes.Error},
+	}
+	spans := rec.Ended()
+	if len(spans) != len(tt)+1 {
+		t.Fatalf("Run() ended %d spans, want %d", len(spans), len(tt)+1)
+	}
+	for i, c := range tt {
+		span := spans[i]
+		if span.Name() != c.name || span.Status().Code != c.status {
+			t.Errorf("Test %d: Run() got span %s (%v), want %s (%v)", i+1, span.Name(), span.Status().Code, c.name, c.status)
+		}
+		if span.Parent().SpanID() != deploy.SpanContext().SpanID() {
+			t.Errorf("Test %d: Run() got span %s outside the deploy's trace", i+1, span.Name())
+		}
+	}
+}
+
+func TestParsePipelines(t *testing.T) {
+	c, err := config.Parse([]byte(`
+pipelines:
+  time:
+    - name: change-ticket
+      type: webhook
+      before: commit
+      url: https://example.com/tickets
+`))
+	if err != nil {
+		t.Fatalf("Parse() error: %s", err)
+	}
+	if got := len(c.Pipelines["time"]); got != 1 {
+		t.Fatalf("Parse() got %d stages for time, want 1", got)
+	}
+	if got := c.Pipelines["time"][0].Before; got != pipeline.StageCommit {
+		t.Errorf("Parse() got before %s, want %s", got, pipeline.StageCommit)
+	}
+
+	p, err := pipeline.FromConfig(c, "time")
+	if err != nil {
+		t.Fatalf("FromConfig(time) error: %s", err)
+	}
+	builtin, skipped := p.WithoutCustom()
+	if !reflect.DeepEqual(skipped, []string{"change-ticket"}) {
+		t.Errorf("WithoutCustom() skipped %v, want [change-ticket]", skipped)
+	}
+	if got, want := builtin.Names(), pipeline.Default().Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("WithoutCustom() got stages %v, want %v", got, want)
+	}
+}
+
+// flowStage declares what it reads and fills without doing anything
+type flowStage struct {
+	name         string
+	reads, fills []string
+}
+
+func (f flowStage) Name() string              { return f.name }
+func (f flowStage) Run(*pipeline.State) error { return nil }
+func (f flowStage) Reads() []string           { return f.reads }
+func (f flowStage) Fills() []string           { return f.fills }
+
+func TestCheckFlow(t *testing.T) {
+	tt := []struct {
+		desc    string
+		stages  []pipeline.Stage
+		wantErr bool
+	}{
+		{"Inputs only", []pipeline.Stage{flowStage{name: "a", reads: []string{"Text", "Env"}}}, false},
+		{"Filled earlier", []pipeline.Stage{flowStage{name: "a", fills: []string{"App"}}, flowStage{name: "b", reads: []string{"App"}}}, false},
+		{"Filled later", []pipeline.Stage{flowStage{name: "a", reads: []string{"App"}}, flowStage{name: "b", fills: []string{"App"}}}, true},
+		{"Unknown field", []pipeline.Stage{flowStage{name: "a", fills: []string{"Tag"}}}, true},
+		{"Stages without a flow", []pipeline.Stage{stage{name: "a"}}, false},
+	}
+	for i, c := range tt {
+		t.Run(c.desc, func(t *testing.T) {
+			err := pipeline.New(c.stages...).CheckFlow()
+			if (err != nil) != c.wantErr {
+				t.Errorf("Test %d: CheckFlow() got error %v, want error %v", i+1, err, c.wantErr)
+			}
+		})
+	}
+	if err := pipeline.Default().CheckFlow(); err != nil {
+		t.Errorf("Default().CheckFlow() error: %s", err)
+	}
+
+	// A custom stage ahead of validate would run before there's an app to post
+	c, err := config.Parse([]byte(`
+pipelines:
+  time:
+    - name: too-early
+      type: webhook
+      before: validate
+      url: https://example.com/hook
+`))
+	if err != nil {
+		t.Fatalf("Parse() error: %s", err)
+	}
+	if _, err := pipeline.FromConfig(c, "time"); err == nil {
+		t.Errorf("FromConfig(time) with a webhook before validate got no error")
+	}
+}
@@ -0,0 +1,208 @@
+package pipeline
+
+import (
+	gh "deploy-bot/github"
+	"deploy-bot/logging"
+	"deploy-bot/util"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long the sync stage waits for the githook to be forwarded to Argo before
+// requesting the sync anyway; Argo resolves the latest gitops revision either way
+const HookTimeout = 2 * time.Minute
+
+func fail(msg string) error {
+	return &StageError{Msg: msg}
+}
+
+// validate reads Text, fills App and Ref
+type validate struct{}
+
+func (validate) Name() string    { return StageValidate }
+func (validate) Reads() []string { return []string{"Text"} }
+func (validate) Fills() []string { return []string{"App", "Ref"} }
+
+func (validate) Run(s *State) error {
+	valid, msg, app, ref := util.CheckArgsValid(s.Text)
+	if valid != true {
+		return fail(msg)
+	}
+	s.App, s.Ref = app, ref
+	return nil
+}
+
+// resolveRef reads App and Ref, fills PR (nil when deploying main)
+type resolveRef struct{}
+
+func (resolveRef) Name() string    { return StageResolveRef }
+func (resolveRef) Reads() []string { return []string{"App", "Ref"} }
+func (resolveRef) Fills() []string { return []string{"PR"} }
+
+func (resolveRef) Run(s *State) error {
+	prNum, _ := strconv.Atoi(s.Ref)
+	pr, err := s.Repo.PullRequest(s.Ctx, s.App, prNum)
+	if err != nil {
+		return &StageError{Msg: fmt.Sprintf("_Error: %s_", err), Err: err}
+	}
+
+	if pr != nil { // A known PR was provided
+		s.notify(fmt.Sprintf("_Fetching %v _", pr.GetHTMLURL()))
+	} else if s.Ref != "main" { // Non-main branch was provided
+		return fail(fmt.Sprintf("_Error: %s has no PR %s_", s.App, s.Ref))
+	} else { // Main branch was provided
+		s.notify(fmt.Sprintf("_Fetching `%s` for %s _", s.Ref, s.App))
+	}
+	s.PR = pr
+	return nil
+}
+
+// verifyImage reads App and PR, fills SHA and ImageTag
+type verifyImage struct{}
+
+func (verifyImage) Name() string    { return StageVerifyImage }
+func (verifyImage) Reads() []string { return []string{"App", "PR"} }
+func (verifyImage) Fills() []string { return []string{"SHA", "ImageTag"} }
+
+func (verifyImage) Run(s *State) error {
+	// Images are tagged after the branch and commit they were built from
+	ref, sha := "main", ""
+	if s.PR == nil {
+		head, err := s.Repo.HeadCommit(s.Ctx, s.App, ref)
+		if err != nil {
+			return &StageError{Msg: fmt.Sprintf("_Error: %s_", err), Err: err}
+		}
+		sha = head
+	} else {
+		ref, sha = s.PR.Head.GetRef(), s.PR.Head.GetSHA()
+	}
+	s.SHA, s.ImageTag = sha, *util.BuildDockerImageString(ref, sha)
+
+	tagExists, err := s.Registry.ImageExists(s.Ctx, s.App, s.ImageTag)
+	if err != nil {
+		return &StageError{Msg: fmt.Sprintf("_Error listing images in ECR: %s_", err), Err: err}
+	}
+	if tagExists != true {
+		return fail(fmt.Sprintf("_`%s` does not exist in ECR_", s.ImageTag))
+	}
+	return nil
+}
+
+// verifyChecks reads App, SHA and ImageTag
+type verifyChecks struct{}
+
+func (verifyChecks) Name() string    { return StageVerifyChecks }
+func (verifyChecks) Reads() []string { return []string{"App", "SHA", "ImageTag"} }
+func (verifyChecks) Fills() []string { return nil }
+
+func (verifyChecks) Run(s *State) error {
+	completed := s.Repo.ChecksCompleted(s.Ctx, s.App, s.SHA)
+	if completed != true {
+		return fail(fmt.Sprintf("`_%s` has not been promoted to ECR; Github Actions are still underway_", s.ImageTag))
+	}
+	return nil
+}
+
+// renderValues reads App and ImageTag, fills RepoContent, OldValues and NewValues
+type renderValues struct{}
+
+func (renderValues) Name() string    { return StageRenderValues }
+func (renderValues) Reads() []string { return []string{"App", "ImageTag"} }
+func (renderValues) Fills() []string { return []string{"RepoContent", "OldValues", "NewValues"} }
+
+func (renderValues) Run(s *State) error {
+	rc, repoContent, err := s.GitOps.DownloadValues(s.Ctx, s.App)
+	if err != nil {
+		return &StageError{Msg: fmt.Sprintf("_Error %s_", err.Error()), Err: err}
+	}
+	s.notify(fmt.Sprintf("_ Downloading %s _", repoContent.GetHTMLURL()))
+	defer rc.Close()
+	oldValues, _ := io.ReadAll(rc)
+
+	values, _, msg := gh.UpdateValues(strings.NewReader(string(oldValues)), s.ImageTag)
+	if msg != "" {
+		return fail(msg)
+	}
+	s.RepoContent = repoContent
+	s.OldValues = string(oldValues)
+	s.NewValues = values
+	return nil
+}
+
+// approve reads everything the approver needs to see via State.Approve
+type approve struct{}
+
+func (approve) Name() string { return StageApprove }
+func (approve) Reads() []string {
+	return []string{"App", "Ref", "ImageTag", "OldValues", "NewValues", "Approve"}
+}
+func (approve) Fills() []string { return nil }
+
+func (approve) Run(s *State) error {
+	if s.Approve == nil {
+		return nil
+	}
+	return s.Approve(s)
+}
+
+// commit reads App, ImageTag, NewValues and RepoContent, fills GitopsCommit.
+// This triggers the Github webhook with request inbound for /githook
+type commit struct{}
+
+func (commit) Name() string    { return StageCommit }
+func (commit) Reads() []string { return []string{"App", "ImageTag", "NewValues", "RepoContent"} }
+func (commit) Fills() []string { return []string{"GitopsCommit"} }
+
+func (commit) Run(s *State) error {
+	sha, err := s.GitOps.PushValues(s.Ctx, s.App, s.ImageTag, s.NewValues, s.RepoContent)
+	if err != nil {
+		return &StageError{Msg: fmt.Sprintf("_Error %s_", err.Error()), Err: err}
+	}
+	s.GitopsCommit = sha
+	s.notify(fmt.Sprintf("_Updating image.tag to `%s`_", s.ImageTag))
+	return nil
+}
+
+// syncApp reads App and Hook
+type syncApp struct{}
+
+func (syncApp) Name() string    { return StageSync }
+func (syncApp) Reads() []string { return []string{"App", "Hook"} }
+func (syncApp) Fills() []string { return nil }
+
+func (syncApp) Run(s *State) error {
+	select {
+	case <-s.Hook:
+	case <-time.After(HookTimeout):
+		logging.FromContext(s.Ctx).Warnf("Githook for %s not received after %s, syncing anyway", s.App, HookTimeout)
+	case <-s.Ctx.Done():
+		return s.Ctx.Err()
+	}
+	msg, err := s.CD.Sync(s.Ctx, s.App)
+	if err != nil {
+		logging.FromContext(s.Ctx).Errorf("Error syncing application in Argocd: %s", err.Error())
+		return &StageError{Msg: msg, Err: err}
+	}
+	s.notify(msg)
+	return nil
+}
+
+// watch reads App, fills Result
+type watch struct{}
+
+func (watch) Name() string    { return StageWatch }
+func (watch) Reads() []string { return []string{"App"} }
+func (watch) Fills() []string { return []string{"Result"} }
+
+func (watch) Run(s *State) error {
+	s.Result = s.CD.WatchSync(s.Ctx, s.App, s.notify)
+	if s.Result != "Synced" {
+		// DoStatusLoop has already explained itself in Slack
+		return &StageError{Err: errors.New(s.Result)}
+	}
+	return nil
+}
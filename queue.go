@@ -0,0 +1,151 @@
+package main
+
+import (
+	"deploy-bot/audit"
+	"deploy-bot/auth"
+	"deploy-bot/logging"
+	"deploy-bot/queue"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"deploy-bot/util"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// enqueueDeploy validates a deploy mention and queues it behind any other deploys of the same app.
+// A non-empty override is an admin's reason for deploying through a freeze
+func (b *Bot) enqueueDeploy(text, user, override string, connInfo slackbot.ConnInfo) {
+	valid, msg, app, ref := util.CheckArgsValid(text)
+	if valid != true {
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if !b.authorize(user, app, auth.Deployer, connInfo) {
+		return
+	}
+	env := util.GetEnvironment(connInfo.Channel)
+	if override != "" {
+		if !b.authorize(user, app, auth.Admin, connInfo) {
+			return
+		}
+	} else if f := b.activeFreeze(env); f != nil {
+		b.Slack.SendMessage(connInfo, frozenMsg(f, env, app, ref))
+		return
+	}
+
+	record := &store.Deploy{
+		Requester:   user,
+		App:         app,
+		Environment: env,
+		Ref:         ref,
+		Stage:       store.StageQueued,
+		Result:      "queued",
+		Thread:      b.Slack.Permalink(connInfo),
+		Channel:     connInfo.Channel,
+		ThreadTS:    connInfo.Timestamp,
+		Override:    override,
+		RequestedAt: time.Now(),
+	}
+	b.saveDeploy(record)
+	if override != "" {
+		logging.Infof("Deploy #%d of %s to %s: %s overrode any freeze: %s", record.ID, app, env, user, override)
+		b.auditEvent(audit.Entry{Actor: user, Action: "freeze-override", Channel: connInfo.Channel, App: app, Env: env, Outcome: "allowed", Detail: override})
+		msg := fmt.Sprintf("_⚠️ <@%s> is deploying `%s` to %s regardless of freezes: %s_", user, app, env, override)
+		b.Slack.SendMessage(connInfo, msg)
+	}
+
+	r := &queue.Request{
+		ID:   record.ID, // Share IDs with the deploy history
+		App:  app,
+		Env:  record.Environment,
+		Ref:  ref,
+		User: user,
+		Run: func() {
+			b.doDeploy(text, record, connInfo)
+		},
+		Notify: func(msg string) {
+			b.Slack.SendMessage(connInfo, msg)
+		},
+	}
+	ahead := b.Deploys.Enqueue(r)
+	if ahead > 0 {
+		msg := fmt.Sprintf("_Deploy #%d queued at position %d for `%s` (%s)_", r.ID, ahead, app, r.Env)
+		b.Slack.SendMessage(connInfo, msg)
+	}
+}
+
+// doQueue handles `@bot queue`
+func (b *Bot) doQueue(user string, connInfo slackbot.ConnInfo) {
+	if !b.authorize(user, "", auth.Viewer, connInfo) {
+		return
+	}
+	rs := b.Deploys.List()
+	if len(rs) == 0 {
+		b.Slack.SendMessage(connInfo, "_No deploys running or queued_")
+		return
+	}
+	lines := make([]string, len(rs))
+	for i, r := range rs {
+		lines[i] = r.String()
+	}
+	b.Slack.SendMessage(connInfo, strings.Join(lines, "\n"))
+}
+
+// doCancel handles `@bot cancel <id>`; admins may cancel anyone's queued or running deploy
+func (b *Bot) doCancel(text, user string, connInfo slackbot.ConnInfo) {
+	args := strings.Split(text, " ")
+	id, err := strconv.Atoi(strings.TrimPrefix(args[len(args)-1], "#"))
+	if len(args) != 2 || err != nil {
+		msg := fmt.Sprintf("_Usage: @%s cancel <id>_", os.Getenv("SLACKBOT_NAME"))
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+
+	// Authorized against the deploy being cancelled, not the channel cancel was typed in
+	app, env := "", util.GetEnvironment(connInfo.Channel)
+	for _, r := range b.Deploys.List() {
+		if r.ID == id {
+			app, env = r.App, r.Env
+		}
+	}
+	if app != "" && !b.authorizeIn(user, app, env, auth.Deployer, connInfo) {
+		return
+	}
+	if v, ok := b.running.Load(id); ok {
+		b.cancelRunning(v.(*runningDeploy), user, connInfo)
+		return
+	}
+	r, err := b.Deploys.Cancel(id, user, b.Authz.Can(user, app, env, auth.Admin))
+	if err != nil {
+		b.auditEvent(audit.Entry{Actor: user, Action: "cancel", Channel: connInfo.Channel, App: app, Env: env, Outcome: "failed", Detail: err.Error()})
+		msg := fmt.Sprintf("_Error: %s_", err)
+		b.Slack.SendMessage(connInfo, msg)
+		return
+	}
+	if record, err := b.History.Get(r.ID); err == nil {
+		b.finishRecord(record, fmt.Sprintf("cancelled by <@%s>", user))
+	}
+	b.auditEvent(audit.Entry{Actor: user, Action: "cancel", Channel: connInfo.Channel, App: r.App, Env: r.Env, Outcome: "cancelled", Detail: fmt.Sprintf("deploy #%d", r.ID)})
+	msg := fmt.Sprintf("_Deploy #%d of `%s` %s cancelled_", r.ID, r.App, r.Ref)
+	b.Slack.SendMessage(connInfo, msg)
+	r.Notify(fmt.Sprintf("_Deploy #%d was cancelled by <@%s>_", r.ID, user))
+}
+
+// cancelRunning stops a deploy part way through its pipeline by cancelling its context.
+// runDeploy records the outcome once the stage it was in has stopped
+func (b *Bot) cancelRunning(rd *runningDeploy, user string, connInfo slackbot.ConnInfo) {
+	id, app, env, requester := rd.record.ID, rd.record.App, rd.record.Environment, rd.record.Requester
+	if requester != user && !b.Authz.Can(user, app, env, auth.Admin) {
+		err := fmt.Errorf("deploy #%d belongs to <@%s>", id, requester)
+		b.auditEvent(audit.Entry{Actor: user, Action: "cancel", Channel: connInfo.Channel, App: app, Env: env, Outcome: "failed", Detail: err.Error()})
+		b.Slack.SendMessage(connInfo, fmt.Sprintf("_Error: %s_", err))
+		return
+	}
+	rd.cancelBy(user)
+	b.auditEvent(audit.Entry{Actor: user, Action: "cancel", Channel: connInfo.Channel, App: app, Env: env, Outcome: "cancelled", Detail: fmt.Sprintf("running deploy #%d", id)})
+	msg := fmt.Sprintf("_Cancelling deploy #%d of `%s`. Anything it already pushed stays pushed_", id, app)
+	b.Slack.SendMessage(connInfo, msg)
+}
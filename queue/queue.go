@@ -0,0 +1,146 @@
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Request struct {
+	ID     int
+	App    string
+	Env    string
+	Ref    string
+	User   string // Slack user ID
+	Queued time.Time
+
+	// Run performs the deploy, the next request for the app starts once it returns
+	Run func()
+	// Notify posts to the requester's thread
+	Notify func(msg string)
+
+	waited  bool
+	started time.Time
+}
+
+func (r *Request) Running() bool {
+	return !r.started.IsZero()
+}
+
+func (r *Request) String() string {
+	s := fmt.Sprintf("#%d `%s` (%s) %s by <@%s>", r.ID, r.App, r.Env, r.Ref, r.User)
+	if r.Running() {
+		return s + fmt.Sprintf(", running for %s", time.Since(r.started).Round(time.Second))
+	}
+	return s + fmt.Sprintf(", queued for %s", time.Since(r.Queued).Round(time.Second))
+}
+
+// Queue runs deploys for the same app one at a time, in the order they were requested,
+// whichever environment they are for. Different apps have their own workers and run in parallel
+type Queue struct {
+	mu      sync.Mutex
+	nextID  int
+	pending map[string][]*Request
+	running map[string]*Request
+}
+
+func New() *Queue {
+	return &Queue{
+		nextID:  1,
+		pending: make(map[string][]*Request),
+		running: make(map[string]*Request),
+	}
+}
+
+// key is what requests are serialized on: the app, for the same reason locks are per app (see lock.key)
+func key(app string) string {
+	return app
+}
+
+// Enqueue schedules r, returning the number of requests ahead of it.
+// r is assigned an ID unless the caller already set one
+func (q *Queue) Enqueue(r *Request) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if r.ID == 0 {
+		r.ID = q.nextID
+		q.nextID++
+	}
+	r.Queued = time.Now()
+
+	k := key(r.App)
+	q.pending[k] = append(q.pending[k], r)
+	ahead := len(q.pending[k]) - 1
+	if _, ok := q.running[k]; ok {
+		ahead++
+	} else if ahead == 0 {
+		go q.work(k)
+	}
+	r.waited = ahead > 0
+	return ahead
+}
+
+// work drains the pending requests for one app
+func (q *Queue) work(k string) {
+	for {
+		q.mu.Lock()
+		if len(q.pending[k]) == 0 {
+			delete(q.pending, k)
+			delete(q.running, k)
+			q.mu.Unlock()
+			return
+		}
+		r := q.pending[k][0]
+		q.pending[k] = q.pending[k][1:]
+		r.started = time.Now()
+		q.running[k] = r
+		q.mu.Unlock()
+
+		if r.Notify != nil && r.waited {
+			r.Notify(fmt.Sprintf("_Deploy #%d is starting_", r.ID))
+		}
+		r.Run()
+	}
+}
+
+// Cancel withdraws a pending request. Only the requester can cancel unless force is set
+func (q *Queue) Cancel(id int, user string, force bool) (*Request, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for k, rs := range q.pending {
+		for i, r := range rs {
+			if r.ID != id {
+				continue
+			}
+			if r.User != user && !force {
+				return r, fmt.Errorf("deploy #%d belongs to <@%s>", id, r.User)
+			}
+			q.pending[k] = append(rs[:i:i], rs[i+1:]...)
+			return r, nil
+		}
+	}
+	for _, r := range q.running {
+		if r.ID == id {
+			return r, fmt.Errorf("deploy #%d is already running", id)
+		}
+	}
+	return nil, fmt.Errorf("deploy #%d is not queued", id)
+}
+
+// List returns copies of the running and pending requests, ordered by ID
+func (q *Queue) List() []Request {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var rs []Request
+	for _, r := range q.running {
+		rs = append(rs, *r)
+	}
+	for _, p := range q.pending {
+		for _, r := range p {
+			rs = append(rs, *r)
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].ID < rs[j].ID })
+	return rs
+}
@@ -0,0 +1,80 @@
+package queue_test
+
+import (
+	"deploy-bot/queue"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestEnqueueRunsInOrder(t *testing.T) {
+	q := queue.New()
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+
+	run := func(n int) func() {
+		return func() {
+			<-release
+			mu.Lock()
+			order = append(order, n)
+			mu.Unlock()
+			wg.Done()
+		}
+	}
+
+	tt := []struct {
+		app  string
+		env  string
+		want int
+	}{
+		{"time", "staging", 0},
+		{"time", "staging", 1},
+		{"sales", "staging", 0},
+		{"time", "staging", 2},
+		{"time", "production", 3}, // Same values file and Argo app as staging
+	}
+	wg.Add(len(tt))
+	for i, r := range tt {
+		got := q.Enqueue(&queue.Request{App: r.app, Env: r.env, Run: run(i)})
+		if got != r.want {
+			t.Errorf("Test %d: Enqueue(%s) got position %d, want %d", i+1, r.app, got, r.want)
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	// Only the relative order of the time deploys is guaranteed
+	var times []int
+	for _, n := range order {
+		if n != 2 {
+			times = append(times, n)
+		}
+	}
+	if !reflect.DeepEqual(times, []int{0, 1, 3, 4}) {
+		t.Errorf("time deploys ran in order %v, want [0 1 3 4]", times)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	q := queue.New()
+	block := make(chan struct{})
+	defer close(block)
+	q.Enqueue(&queue.Request{App: "time", Env: "staging", User: "U1", Run: func() { <-block }})
+	r := &queue.Request{App: "time", Env: "staging", User: "U1", Run: func() {}}
+	q.Enqueue(r)
+
+	if _, err := q.Cancel(r.ID, "U2", false); err == nil {
+		t.Errorf("Cancel by another user succeeded")
+	}
+	if _, err := q.Cancel(r.ID, "U1", false); err != nil {
+		t.Errorf("Cancel by requester failed: %s", err)
+	}
+	if _, err := q.Cancel(r.ID, "U1", false); err == nil {
+		t.Errorf("Cancel of an already cancelled deploy succeeded")
+	}
+	if n := len(q.List()); n != 1 {
+		t.Errorf("List() got %d requests, want 1", n)
+	}
+}
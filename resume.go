@@ -0,0 +1,87 @@
+package main
+
+import (
+	"deploy-bot/logging"
+	"deploy-bot/pipeline"
+	"deploy-bot/queue"
+	slackbot "deploy-bot/slack"
+	"deploy-bot/store"
+	"fmt"
+)
+
+// resumeDeploys picks up deploys that were in flight when the bot last stopped.
+// They are queued again in their original order and report back in their original threads
+func (b *Bot) resumeDeploys() {
+	unfinished, err := b.History.Unfinished()
+	if err != nil {
+		logging.Errorf("Error reading unfinished deploys: %s", err)
+		return
+	}
+
+	for i := range unfinished {
+		record := &unfinished[i]
+		if record.Channel == "" { // Recorded before threads were persisted, nowhere to report back to
+			b.finishRecord(record, "abandoned: bot restarted")
+			continue
+		}
+		deployLogger(record).Infof("Resuming deploy #%d of %s at stage %s", record.ID, record.App, record.Stage)
+		connInfo := slackbot.ConnInfo{
+			Client:    slackbot.Client(),
+			Channel:   record.Channel,
+			Timestamp: record.ThreadTS,
+		}
+		msg := fmt.Sprintf("_I restarted, resuming deploy #%d from the `%s` stage_", record.ID, record.Stage)
+		b.Slack.SendMessage(connInfo, msg)
+
+		r := &queue.Request{
+			ID:   record.ID,
+			App:  record.App,
+			Env:  record.Environment,
+			Ref:  record.Ref,
+			User: record.Requester,
+			Run: func() {
+				text := fmt.Sprintf("<@resume> %s %s", record.App, record.Ref)
+				b.runDeploy(text, record, connInfo, b.resumeStage(record))
+			},
+			Notify: func(msg string) {
+				b.Slack.SendMessage(connInfo, msg)
+			},
+		}
+		b.Deploys.Enqueue(r)
+	}
+}
+
+// resumeStage works out where a deploy's pipeline should pick up again. Everything
+// before the commit has no side effects so it is simply run again from the start.
+// Later stages pick up where they were; a deploy watching Argo goes back to watching,
+// as Argo refuses another sync while the one it requested is still running
+func (b *Bot) resumeStage(record *store.Deploy) string {
+	p, err := pipeline.ForApp(record.App)
+	if err != nil {
+		return ""
+	}
+	stage, committed := -1, -1
+	for i, name := range p.Names() {
+		if name == record.Stage {
+			stage = i
+		}
+		if name == pipeline.StageCommit {
+			committed = i
+		}
+	}
+
+	switch {
+	case stage == committed || stage == -1:
+		// Stopped at the commit, or at a stage this pipeline no longer has. If the commit landed
+		// before the restart, running it again would find the tag already set, so sync it instead
+		tag, err := b.GitOps.CurrentImageTag(b.ctx, record.App)
+		if err != nil || record.ImageTag == "" || tag != record.ImageTag {
+			return ""
+		}
+		return pipeline.StageSync
+	case stage < committed:
+		return ""
+	default:
+		return record.Stage
+	}
+}
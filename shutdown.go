@@ -0,0 +1,100 @@
+package main
+
+import (
+	"deploy-bot/logging"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long deploys get to report back to their threads once shutdown cancels them
+const abandonTimeout = 10 * time.Second
+
+// inflight counts the mentions, githooks and deploys being worked on, so shutdown
+// can wait for them. Once draining, no new mentions or deploys are admitted
+type inflight struct {
+	mu       sync.Mutex
+	n        int
+	draining bool
+	idle     chan struct{} // Closed once draining with nothing left in flight
+	closed   bool          // idle is closed, githooks can still come and go after that
+}
+
+// admit counts new work unless the bot is draining
+func (f *inflight) admit() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.draining {
+		return false
+	}
+	f.n++
+	return true
+}
+
+// add counts work that has to be done even while draining, like the githooks
+// that let in-flight deploys carry on
+func (f *inflight) add() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n++
+}
+
+func (f *inflight) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 && f.draining {
+		f.close()
+	}
+}
+
+// close closes idle the first time nothing is left in flight. Callers hold f.mu
+func (f *inflight) close() {
+	if !f.closed {
+		f.closed = true
+		close(f.idle)
+	}
+}
+
+// drain stops admitting work, returning a channel closed once everything in flight is done
+func (f *inflight) drain() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.draining {
+		f.draining = true
+		f.idle = make(chan struct{})
+		if f.n == 0 {
+			f.close()
+		}
+	}
+	return f.idle
+}
+
+// gracePeriod is how long shutdown waits for in-flight deploys, from SHUTDOWN_GRACE_PERIOD
+func gracePeriod() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("SHUTDOWN_GRACE_PERIOD"))
+	if err != nil || d <= 0 {
+		return 25 * time.Second // Inside Kubernetes' default 30s termination grace period
+	}
+	return d
+}
+
+// Shutdown stops taking new mentions and waits up to grace for in-flight work. Deploys
+// still running after that are cancelled, tell their threads and are left to resume on restart
+func (b *Bot) Shutdown(grace time.Duration) {
+	logging.Infof("Shutting down, waiting up to %s for in-flight work", grace)
+	idle := b.inflight.drain()
+	select {
+	case <-idle:
+		logging.Infof("Nothing left in flight")
+	case <-time.After(grace):
+		logging.Infof("Grace period over, stopping running deploys")
+		b.stop()
+		select {
+		case <-idle:
+		case <-time.After(abandonTimeout):
+			logging.Infof("Deploys did not stop within %s, exiting anyway", abandonTimeout)
+		}
+	}
+	b.stop()
+}
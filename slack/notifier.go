@@ -0,0 +1,119 @@
+package slack
+
+import (
+	"deploy-bot/logging"
+	"deploy-bot/metrics"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// MaxAttempts is how many times a message is tried before it is given up on
+const MaxAttempts = 5
+
+// Notifier delivers messages to Slack one thread at a time and in order, retrying
+// when Slack rate limits us. Each thread gets its own queue, so a burst in one
+// deploy's thread doesn't hold up another's
+type Notifier struct {
+	mu      sync.Mutex
+	threads map[string][]*job
+	pending sync.WaitGroup
+	failed  int64
+
+	// Sleep waits out rate limits, swapped out by tests
+	Sleep func(d time.Duration)
+}
+
+type job struct {
+	send func() error
+	done chan error // Nil when nobody is waiting on the result
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{threads: make(map[string][]*job), Sleep: time.Sleep}
+}
+
+func threadKey(conn ConnInfo) string {
+	return conn.Channel + "/" + conn.Timestamp
+}
+
+// Send queues send behind everything else for the thread and returns straight away
+func (n *Notifier) Send(conn ConnInfo, send func() error) {
+	n.enqueue(threadKey(conn), &job{send: send})
+}
+
+// Do queues send behind everything else for the thread and waits for it to be delivered
+func (n *Notifier) Do(conn ConnInfo, send func() error) error {
+	j := &job{send: send, done: make(chan error, 1)}
+	n.enqueue(threadKey(conn), j)
+	return <-j.done
+}
+
+func (n *Notifier) enqueue(key string, j *job) {
+	n.pending.Add(1)
+	n.mu.Lock()
+	q, running := n.threads[key]
+	n.threads[key] = append(q, j)
+	n.mu.Unlock()
+	if !running {
+		go n.drain(key)
+	}
+}
+
+// drain delivers the thread's queue until it is empty, then forgets the thread
+func (n *Notifier) drain(key string) {
+	for {
+		n.mu.Lock()
+		q := n.threads[key]
+		if len(q) == 0 {
+			delete(n.threads, key)
+			n.mu.Unlock()
+			return
+		}
+		j := q[0]
+		n.threads[key] = q[1:]
+		n.mu.Unlock()
+
+		err := n.deliver(j.send)
+		if err != nil {
+			atomic.AddInt64(&n.failed, 1)
+			metrics.APIError("slack", "send", err)
+			logging.Errorf("Error sending Slack message to %s: %s", key, err)
+		}
+		if j.done != nil {
+			j.done <- err
+		}
+		n.pending.Done()
+	}
+}
+
+// deliver retries send while Slack asks us to slow down, waiting as long as it says to
+func (n *Notifier) deliver(send func() error) error {
+	var err error
+	for attempt := 1; attempt <= MaxAttempts; attempt++ {
+		err = send()
+		var rl *slack.RateLimitedError
+		if !errors.As(err, &rl) {
+			return err
+		}
+		if attempt == MaxAttempts {
+			break // Waiting out the limit would only hold up the thread's next message
+		}
+		logging.Warnf("Rate limited by Slack, retrying in %s (attempt %d of %d)", rl.RetryAfter, attempt, MaxAttempts)
+		n.Sleep(rl.RetryAfter)
+	}
+	return err
+}
+
+// Failed returns how many messages could not be delivered
+func (n *Notifier) Failed() int64 {
+	return atomic.LoadInt64(&n.failed)
+}
+
+// Wait blocks until every queued message has been delivered or given up on
+func (n *Notifier) Wait() {
+	n.pending.Wait()
+}
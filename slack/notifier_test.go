@@ -0,0 +1,85 @@
+package slack_test
+
+import (
+	"deploy-bot/slack"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	slackapi "github.com/slack-go/slack"
+)
+
+func TestNotifierOrder(t *testing.T) {
+	n := slack.NewNotifier()
+	var mu sync.Mutex
+	got := map[string][]int{}
+
+	threads := []slack.ConnInfo{{Channel: "C1", Timestamp: "1.1"}, {Channel: "C1", Timestamp: "2.2"}}
+	for i := 0; i < 20; i++ {
+		for _, conn := range threads {
+			conn, i := conn, i
+			n.Send(conn, func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				got[conn.Timestamp] = append(got[conn.Timestamp], i)
+				return nil
+			})
+		}
+	}
+	n.Wait()
+
+	for _, conn := range threads {
+		for i, v := range got[conn.Timestamp] {
+			if v != i {
+				t.Fatalf("Thread %s message %d got %d, want messages in order: %v", conn.Timestamp, i, v, got[conn.Timestamp])
+			}
+		}
+		if len(got[conn.Timestamp]) != 20 {
+			t.Errorf("Thread %s got %d messages, want 20", conn.Timestamp, len(got[conn.Timestamp]))
+		}
+	}
+}
+
+func TestNotifierRetry(t *testing.T) {
+	conn := slack.ConnInfo{Channel: "C1", Timestamp: "1.1"}
+	tt := []struct {
+		desc       string
+		errs       []error
+		wantTries  int
+		wantSlept  time.Duration
+		wantErr    bool
+		wantFailed int64
+	}{
+		{"Delivered", []error{nil}, 1, 0, false, 0},
+		{"Rate limited once", []error{&slackapi.RateLimitedError{RetryAfter: 3 * time.Second}, nil}, 2, 3 * time.Second, false, 0},
+		{"Other errors are not retried", []error{errors.New("channel_not_found")}, 1, 0, true, 1},
+		{"Gives up", repeat(&slackapi.RateLimitedError{RetryAfter: time.Second}, slack.MaxAttempts), slack.MaxAttempts, (slack.MaxAttempts - 1) * time.Second, true, 1},
+	}
+	for i, v := range tt {
+		t.Run(v.desc, func(t *testing.T) {
+			n := slack.NewNotifier()
+			var slept time.Duration
+			n.Sleep = func(d time.Duration) { slept += d }
+			tries := 0
+			err := n.Do(conn, func() error {
+				tries++
+				return v.errs[tries-1]
+			})
+			got := fmt.Sprintf("%d tries, slept %s, error %v, %d failed", tries, slept, err != nil, n.Failed())
+			want := fmt.Sprintf("%d tries, slept %s, error %v, %d failed", v.wantTries, v.wantSlept, v.wantErr, v.wantFailed)
+			if got != want {
+				t.Errorf("Test %d: Do(%s) got %s, want %s", i+1, v.desc, got, want)
+			}
+		})
+	}
+}
+
+func repeat(err error, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
@@ -1,29 +1,112 @@
 package slack
 
 import (
+	"context"
+	"deploy-bot/logging"
+	"deploy-bot/metrics"
+	"deploy-bot/tracing"
 	"github.com/slack-go/slack"
-	//"log"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
 	"os"
+	"sync"
 )
 
 type ConnInfo struct {
 	Client    *slack.Client
 	Channel   string
 	Timestamp string
+	// Span puts calls for the thread in the trace of the deploy it belongs to, if any
+	Span trace.SpanContext
 }
 
+// context for calls to Slack, in the deploy's trace but not cancelled with it,
+// since a cancelled deploy still has to say so
+func (conn ConnInfo) context() context.Context {
+	return trace.ContextWithSpanContext(context.Background(), conn.Span)
+}
+
+var (
+	client     *slack.Client
+	clientOnce sync.Once
+	notifier   = NewNotifier()
+)
+
+// Client returns the bot's Slack client, shared by everything that talks to Slack
 func Client() *slack.Client {
-	slackToken := os.Getenv("SLACK_AUTH_TOKEN")
-	api := slack.New(slackToken)
-	return api
+	clientOnce.Do(func() {
+		httpClient := &http.Client{Transport: tracing.Transport("slack", http.DefaultTransport)}
+		client = slack.New(os.Getenv("SLACK_AUTH_TOKEN"), slack.OptionHTTPClient(httpClient))
+	})
+	return client
 }
 
+// SendMessage queues msg for the thread, after anything already sent to it
 func SendMessage(conn ConnInfo, msg string) {
-	channel := conn.Channel
-	api := conn.Client
-	ts := conn.Timestamp
 	attachment := buildSlackAttachment(msg)
-	api.PostMessage(channel, slack.MsgOptionAttachments(attachment), slack.MsgOptionTS(ts))
+	notifier.Send(conn, func() error {
+		_, _, err := conn.Client.PostMessageContext(conn.context(), conn.Channel, slack.MsgOptionAttachments(attachment), slack.MsgOptionTS(conn.Timestamp))
+		return err
+	})
+}
+
+// PostBlocks posts a Block Kit message to the thread, returning its timestamp so it can be updated
+func PostBlocks(conn ConnInfo, fallback string, blocks ...slack.Block) (string, error) {
+	var ts string
+	err := notifier.Do(conn, func() error {
+		var err error
+		_, ts, err = conn.Client.PostMessageContext(
+			conn.context(),
+			conn.Channel,
+			slack.MsgOptionText(fallback, false),
+			slack.MsgOptionBlocks(blocks...),
+			slack.MsgOptionTS(conn.Timestamp),
+		)
+		return err
+	})
+	return ts, err
+}
+
+// UpdateBlocks replaces the message at ts with new blocks
+func UpdateBlocks(conn ConnInfo, ts, fallback string, blocks ...slack.Block) error {
+	return notifier.Do(conn, func() error {
+		_, _, _, err := conn.Client.UpdateMessageContext(
+			conn.context(),
+			conn.Channel,
+			ts,
+			slack.MsgOptionText(fallback, false),
+			slack.MsgOptionBlocks(blocks...),
+		)
+		return err
+	})
+}
+
+// Flush waits for every queued message to be delivered
+func Flush() {
+	notifier.Wait()
+}
+
+// FailedMessages returns how many messages Slack never accepted
+func FailedMessages() int64 {
+	return notifier.Failed()
+}
+
+// Permalink returns a link to the thread, or "" if Slack can't provide one
+func Permalink(conn ConnInfo) string {
+	params := slack.PermalinkParameters{Channel: conn.Channel, Ts: conn.Timestamp}
+	link, err := conn.Client.GetPermalinkContext(conn.context(), &params)
+	if err != nil {
+		logging.Errorf("Error getting permalink: %s", err)
+		return ""
+	}
+	return link
+}
+
+// AuthTest is the readiness check for Slack, confirming SLACK_AUTH_TOKEN is valid
+func AuthTest(ctx context.Context) error {
+	_, err := Client().AuthTestContext(ctx)
+	metrics.APIError("slack", "auth_test", err)
+	return err
 }
 
 func buildSlackAttachment(msg string) slack.Attachment {
@@ -40,3 +123,39 @@ func buildSlackAttachment(msg string) slack.Attachment {
 	}
 	return attachment
 }
+
+// UserName returns the user's display name for use outside Slack, or their ID if Slack can't say
+func UserName(user string) string {
+	u, err := Client().GetUserInfo(user)
+	if err != nil {
+		logging.Errorf("Error looking up Slack user %s: %s", user, err)
+		return user
+	}
+	if u.Profile.DisplayName != "" {
+		return u.Profile.DisplayName
+	}
+	return u.RealName
+}
+
+// Messenger posts to Slack through the shared client and notifier
+type Messenger struct{}
+
+func (Messenger) SendMessage(conn ConnInfo, msg string) {
+	SendMessage(conn, msg)
+}
+
+func (Messenger) PostBlocks(conn ConnInfo, fallback string, blocks ...slack.Block) (string, error) {
+	return PostBlocks(conn, fallback, blocks...)
+}
+
+func (Messenger) UpdateBlocks(conn ConnInfo, ts, fallback string, blocks ...slack.Block) error {
+	return UpdateBlocks(conn, ts, fallback, blocks...)
+}
+
+func (Messenger) Permalink(conn ConnInfo) string {
+	return Permalink(conn)
+}
+
+func (Messenger) UserName(user string) string {
+	return UserName(user)
+}
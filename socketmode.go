@@ -0,0 +1,58 @@
+package main
+
+import (
+	"deploy-bot/logging"
+	"os"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// runSocketMode receives events and interactions over an outbound websocket instead of
+// /slackevent and /slackinteraction, so the bot needn't be reachable from the internet.
+// It needs an app-level token with the connections:write scope in SLACK_APP_TOKEN
+func (b *Bot) runSocketMode() {
+	appToken := os.Getenv("SLACK_APP_TOKEN")
+	if appToken == "" {
+		logging.Fatalf("SLACK_SOCKET_MODE is set but SLACK_APP_TOKEN is not")
+	}
+	api := slack.New(os.Getenv("SLACK_AUTH_TOKEN"), slack.OptionAppLevelToken(appToken))
+	client := socketmode.New(api)
+
+	go func() {
+		for evt := range client.Events {
+			switch evt.Type {
+			case socketmode.EventTypeConnecting:
+				logging.Infof("Connecting to Slack in Socket Mode")
+			case socketmode.EventTypeConnected:
+				logging.Infof("Connected to Slack in Socket Mode")
+			case socketmode.EventTypeConnectionError:
+				logging.Warnf("Socket Mode connection error: %v", evt.Data)
+			case socketmode.EventTypeEventsAPI:
+				event, ok := evt.Data.(slackevents.EventsAPIEvent)
+				if !ok {
+					continue
+				}
+				client.Ack(*evt.Request)
+				if event.Type == slackevents.CallbackEvent {
+					b.dispatchEvent(event, evt.Request.RetryAttempt, evt.Request.RetryReason)
+				}
+			case socketmode.EventTypeInteractive:
+				cb, ok := evt.Data.(slack.InteractionCallback)
+				if !ok {
+					continue
+				}
+				if resp := b.handleInteraction(&cb); resp != nil {
+					client.Ack(*evt.Request, resp)
+				} else {
+					client.Ack(*evt.Request)
+				}
+			}
+		}
+	}()
+
+	if err := client.Run(); err != nil {
+		logging.Fatalf("Socket Mode connection failed: %s", err)
+	}
+}
@@ -0,0 +1,249 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	deploysBucket = []byte("deploys")
+	freezesBucket = []byte("freezes")
+)
+
+// Stages a deploy is in either side of its pipeline. In between, the stage is the name of
+// the pipeline stage running, persisted so a restarted bot knows where to resume
+const (
+	StageQueued = "queued"
+	StageDone   = "done"
+)
+
+// Deploy is the persisted record of a single deploy request
+type Deploy struct {
+	ID           int       `json:"id"`
+	Requester    string    `json:"requester"`
+	App          string    `json:"app"`
+	Environment  string    `json:"environment"`
+	Ref          string    `json:"ref"`
+	SHA          string    `json:"sha,omitempty"`
+	ImageTag     string    `json:"image_tag,omitempty"`
+	GitopsCommit string    `json:"gitops_commit,omitempty"`
+	Deployment   int64     `json:"github_deployment,omitempty"` // GitHub Deployment ID on the app's repo
+	Stage        string    `json:"stage"`
+	Result       string    `json:"result"`
+	Thread       string    `json:"thread,omitempty"` // Slack permalink
+	Channel      string    `json:"channel"`
+	ThreadTS     string    `json:"thread_ts"`
+	Override     string    `json:"override,omitempty"` // Why an admin deployed through a freeze
+	RequestedAt  time.Time `json:"requested_at"`
+	StartedAt    time.Time `json:"started_at,omitempty"`
+	FinishedAt   time.Time `json:"finished_at,omitempty"`
+}
+
+func (d *Deploy) String() string {
+	s := fmt.Sprintf("#%d %s `%s` (%s) %s", d.ID, d.RequestedAt.Format("2006-01-02 15:04"), d.App, d.Environment, d.Ref)
+	if d.ImageTag != "" {
+		s += fmt.Sprintf(" → `%s`", d.ImageTag)
+	}
+	s += fmt.Sprintf(" by <@%s>: %s", d.Requester, d.Result)
+	if !d.StartedAt.IsZero() && !d.FinishedAt.IsZero() {
+		s += fmt.Sprintf(" in %s", d.FinishedAt.Sub(d.StartedAt).Round(time.Second))
+	}
+	return s
+}
+
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{deploysBucket, freezesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func itob(id int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// Save inserts or updates d, assigning it an ID the first time it is saved
+func (s *Store) Save(d *Deploy) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deploysBucket)
+		if d.ID == 0 {
+			id, _ := b.NextSequence()
+			d.ID = int(id)
+		}
+		buf, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(d.ID), buf)
+	})
+}
+
+func (s *Store) Get(id int) (*Deploy, error) {
+	var d *Deploy
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deploysBucket).Get(itob(id))
+		if v == nil {
+			return fmt.Errorf("deploy #%d not found", id)
+		}
+		d = &Deploy{}
+		return json.Unmarshal(v, d)
+	})
+	return d, err
+}
+
+// History returns up to n deploys of app, newest first. An empty app matches every app
+func (s *Store) History(app string, n int) ([]Deploy, error) {
+	var deploys []Deploy
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(deploysBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(deploys) < n; k, v = c.Prev() {
+			var d Deploy
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if app == "" || d.App == app {
+				deploys = append(deploys, d)
+			}
+		}
+		return nil
+	})
+	return deploys, err
+}
+
+// Unfinished returns every deploy that has not reached StageDone, oldest first
+func (s *Store) Unfinished() ([]Deploy, error) {
+	var deploys []Deploy
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deploysBucket).ForEach(func(k, v []byte) error {
+			var d Deploy
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.Stage != StageDone && d.FinishedAt.IsZero() {
+				deploys = append(deploys, d)
+			}
+			return nil
+		})
+	})
+	return deploys, err
+}
+
+// ByThread returns the deploy requested by the Slack message at channel/ts, or nil if there isn't one
+func (s *Store) ByThread(channel, ts string) (*Deploy, error) {
+	var found *Deploy
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(deploysBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var d Deploy
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.Channel == channel && d.ThreadTS == ts {
+				found = &d
+				return nil
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Freeze blocks deploys to Env between Start and End. An empty Env freezes every environment
+type Freeze struct {
+	ID     int       `json:"id"`
+	Name   string    `json:"name,omitempty"` // Set for recurring windows from config
+	Env    string    `json:"env"`
+	Reason string    `json:"reason"`
+	By     string    `json:"by,omitempty"` // Slack user ID
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+func (f *Freeze) Active(now time.Time) bool {
+	return !now.Before(f.Start) && now.Before(f.End)
+}
+
+func (f *Freeze) String() string {
+	env := f.Env
+	if env == "" {
+		env = "all environments"
+	}
+	s := fmt.Sprintf("%s %s → %s", env, f.Start.Format("2006-01-02 15:04"), f.End.Format("2006-01-02 15:04 MST"))
+	switch {
+	case f.Name != "":
+		s += fmt.Sprintf(": %s", f.Name)
+	case f.Reason != "":
+		s += fmt.Sprintf(": %s", f.Reason)
+	}
+	if f.By != "" {
+		s += fmt.Sprintf(" (<@%s>)", f.By)
+	}
+	return s
+}
+
+// SaveFreeze inserts or updates f, assigning it an ID the first time it is saved
+func (s *Store) SaveFreeze(f *Freeze) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(freezesBucket)
+		if f.ID == 0 {
+			id, _ := b.NextSequence()
+			f.ID = int(id)
+		}
+		buf, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(f.ID), buf)
+	})
+}
+
+func (s *Store) DeleteFreeze(id int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(freezesBucket).Delete(itob(id))
+	})
+}
+
+// Freezes returns every stored freeze that hasn't ended yet
+func (s *Store) Freezes(now time.Time) ([]Freeze, error) {
+	var freezes []Freeze
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(freezesBucket).ForEach(func(k, v []byte) error {
+			var f Freeze
+			if err := json.Unmarshal(v, &f); err != nil {
+				return err
+			}
+			if now.Before(f.End) {
+				freezes = append(freezes, f)
+			}
+			return nil
+		})
+	})
+	return freezes, err
+}
@@ -0,0 +1,111 @@
+package store_test
+
+import (
+	"deploy-bot/store"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	s, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Open() error: %s", err)
+	}
+	defer s.Close()
+
+	for _, app := range []string{"time", "sales", "time", "time"} {
+		if err := s.Save(&store.Deploy{App: app, Result: "queued"}); err != nil {
+			t.Fatalf("Save(%s) error: %s", app, err)
+		}
+	}
+	d, _ := s.Get(4)
+	d.Result = "Synced"
+	s.Save(d)
+
+	tt := []struct {
+		desc    string
+		app     string
+		n       int
+		wantIDs []int
+	}{
+		{"All apps", "", 10, []int{4, 3, 2, 1}},
+		{"Newest time deploys", "time", 2, []int{4, 3}},
+		{"Single sales deploy", "sales", 10, []int{2}},
+		{"Unknown app", "t1me", 10, nil},
+	}
+	for i, h := range tt {
+		t.Run(h.desc, func(t *testing.T) {
+			got, err := s.History(h.app, h.n)
+			if err != nil {
+				t.Fatalf("Test %d: History(%s,%d) error: %s", i+1, h.app, h.n, err)
+			}
+			if len(got) != len(h.wantIDs) {
+				t.Fatalf("Test %d: History(%s,%d) got %d deploys, want %d", i+1, h.app, h.n, len(got), len(h.wantIDs))
+			}
+			for j, d := range got {
+				if d.ID != h.wantIDs[j] {
+					t.Errorf("Test %d: History(%s,%d)[%d] got #%d, want #%d", i+1, h.app, h.n, j, d.ID, h.wantIDs[j])
+				}
+			}
+		})
+	}
+
+	if got, _ := s.Get(4); got.Result != "Synced" {
+		t.Errorf("Get(4) got result %s, want Synced", got.Result)
+	}
+}
+
+func TestUnfinished(t *testing.T) {
+	s, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Open() error: %s", err)
+	}
+	defer s.Close()
+
+	for _, stage := range []string{store.StageDone, "sync", store.StageQueued, store.StageDone} {
+		s.Save(&store.Deploy{App: "time", Stage: stage})
+	}
+	got, err := s.Unfinished()
+	if err != nil {
+		t.Fatalf("Unfinished() error: %s", err)
+	}
+	if len(got) != 2 || got[0].ID != 2 || got[1].ID != 3 {
+		t.Errorf("Unfinished() got %v, want deploys #2 and #3", got)
+	}
+}
+
+func TestByThread(t *testing.T) {
+	s, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Open() error: %s", err)
+	}
+	defer s.Close()
+
+	s.Save(&store.Deploy{App: "time", Channel: "C1", ThreadTS: "100.1"})
+	s.Save(&store.Deploy{App: "sales", Channel: "C1", ThreadTS: "100.2"})
+
+	tt := []struct {
+		channel string
+		ts      string
+		wantID  int
+	}{
+		{"C1", "100.1", 1},
+		{"C1", "100.2", 2},
+		{"C2", "100.1", 0},
+	}
+	for i, v := range tt {
+		t.Run(v.channel+"/"+v.ts, func(t *testing.T) {
+			got, err := s.ByThread(v.channel, v.ts)
+			if err != nil {
+				t.Fatalf("Test %d: ByThread(%s,%s) error: %s", i+1, v.channel, v.ts, err)
+			}
+			id := 0
+			if got != nil {
+				id = got.ID
+			}
+			if id != v.wantID {
+				t.Errorf("Test %d: ByThread(%s,%s) got #%d, want #%d", i+1, v.channel, v.ts, id, v.wantID)
+			}
+		})
+	}
+}
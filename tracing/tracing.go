@@ -0,0 +1,90 @@
+// Package tracing sets up OpenTelemetry so that a deploy is one trace: a span for the deploy,
+// one per stage, and one per call it makes to Slack, GitHub, ECR and Argo CD
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const name = "deploy-bot"
+
+// Init installs the tracer provider, returning a func that flushes it on shutdown.
+// Spans always get real IDs, so a trace can be quoted in Slack, but are only exported
+// when an OTLP endpoint is configured with the standard OTEL_EXPORTER_OTLP_ENDPOINT
+// or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT; otherwise they go nowhere
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(name))),
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// Transport traces each request made through base as a span named after the service
+// and endpoint, e.g. "argo POST /api/v1/applications/time/sync"
+func Transport(service string, base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return fmt.Sprintf("%s %s %s", service, r.Method, r.URL.Path)
+	}))
+}
+
+// End finishes span, marking it failed when err isn't nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace ctx is part of, or "" when it isn't traced
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// Detach returns a context in the same trace as ctx that is never cancelled, for work
+// that has to happen whether or not the deploy was, like telling Slack it was cancelled
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+}
+
+// URL links to the trace in the tracing UI given by TRACE_URL, e.g.
+// https://jaeger.example.com/trace/{trace_id}, or "" when there's nowhere to link to
+func URL(traceID string) string {
+	tmpl := os.Getenv("TRACE_URL")
+	if tmpl == "" || traceID == "" {
+		return ""
+	}
+	return strings.ReplaceAll(tmpl, "{trace_id}", traceID)
+}
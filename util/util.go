@@ -24,6 +24,32 @@ func AuthorizeUser(user string) bool {
 	return false
 }
 
+// Admins can override locks held by other users
+func IsAdmin(user string) bool {
+	for _, u := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if u != "" && u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Deploys requested from PROTECTED_CHANNEL go to production, anything else goes to DEFAULT_ENVIRONMENT
+func GetEnvironment(channel string) string {
+	if channel != "" && channel == os.Getenv("PROTECTED_CHANNEL") {
+		return "production"
+	}
+	if env := os.Getenv("DEFAULT_ENVIRONMENT"); env != "" {
+		return env
+	}
+	return "staging"
+}
+
+// Environments lists every environment deploys can go to: production and the default one
+func Environments() []string {
+	return []string{"production", GetEnvironment("")}
+}
+
 // Explicitly declare supported apps instead of make additional network call to Github
 func getApps() []string {
 	apps := strings.Split(os.Getenv("SUPPORTED_APPS"), ",")
@@ -80,6 +106,95 @@ func CheckArgsValid(event string) (bool, string, string, string) {
 	return true, "", app, ref
 }
 
+// Subcommands the bot understands in addition to the default `<app> <ref>` deploy
+var commands = map[string]bool{
+	"plan":     true,
+	"lock":     true,
+	"unlock":   true,
+	"queue":    true,
+	"cancel":   true,
+	"history":  true,
+	"freeze":   true,
+	"unfreeze": true,
+	"freezes":  true,
+	"override": true,
+}
+
+// SplitCommand pulls the subcommand out of a mention, returning it along with
+// the remaining event text so it can still be handed to CheckArgsValid
+func SplitCommand(event string) (string, string) {
+	args := strings.Split(event, " ")
+	if len(args) > 1 && commands[args[1]] {
+		rest := append([]string{args[0]}, args[2:]...)
+		return args[1], strings.Join(rest, " ")
+	}
+	return "deploy", event
+}
+
+// DiffLines returns a unified-style diff of two texts, with changed lines
+// prefixed by -/+ and up to 2 lines of unchanged context around each change
+func DiffLines(old, new string) string {
+	a := strings.Split(strings.TrimSuffix(old, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(new, "\n"), "\n")
+
+	// Longest common subsequence table, lcs[i][j] covers a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, "  "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "- "+a[i])
+			i++
+		default:
+			lines = append(lines, "+ "+b[j])
+			j++
+		}
+	}
+
+	// Only keep lines within 2 of a change
+	const context = 2
+	keep := make([]bool, len(lines))
+	for n, l := range lines {
+		if l[0] == ' ' {
+			continue
+		}
+		for k := n - context; k <= n+context; k++ {
+			if k >= 0 && k < len(lines) {
+				keep[k] = true
+			}
+		}
+	}
+	var diff []string
+	for n, l := range lines {
+		if keep[n] {
+			diff = append(diff, l)
+		} else if n > 0 && keep[n-1] {
+			diff = append(diff, "...")
+		}
+	}
+	return strings.Join(diff, "\n")
+}
+
 func GetAppFromPayload(body []byte) (string, error) {
 	application := make(map[string]interface{})
 	err := json.Unmarshal(body, &application)
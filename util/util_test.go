@@ -105,3 +105,47 @@ func TestBuildDockerImageString(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitCommand(t *testing.T) {
+	tt := []struct {
+		desc    string
+		event   string
+		wantCmd string
+		wantTxt string
+	}{
+		{"Default deploy", "XXXX time 18", "deploy", "XXXX time 18"},
+		{"Plan", "XXXX plan time 18", "plan", "XXXX time 18"},
+		{"Plan main", "XXXX plan time main", "plan", "XXXX time main"},
+		{"Only mention", "XXXX", "deploy", "XXXX"},
+	}
+	for i, e := range tt {
+		t.Run(e.desc, func(t *testing.T) {
+			cmd, txt := util.SplitCommand(e.event)
+			if cmd != e.wantCmd || txt != e.wantTxt {
+				t.Errorf("Test %d: SplitCommand(%s) got %s/%s, want %s/%s", i+1, e.event, cmd, txt, e.wantCmd, e.wantTxt)
+			}
+		})
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tt := []struct {
+		desc string
+		old  string
+		new  string
+		want string
+	}{
+		{"No change", "a\nb\n", "a\nb\n", ""},
+		{"Changed tag", "image:\n  tag: main-deadbee\n", "image:\n  tag: main-abcdef1\n", "  image:\n-   tag: main-deadbee\n+   tag: main-abcdef1"},
+		{"Context is trimmed", "a\nb\nc\nd\ne\nf\n", "a\nb\nc\nd\ne\nF\n", "  d\n  e\n- f\n+ F"},
+		{"Added line", "a\n", "a\nb\n", "  a\n+ b"},
+	}
+	for i, d := range tt {
+		t.Run(d.desc, func(t *testing.T) {
+			got := util.DiffLines(d.old, d.new)
+			if got != d.want {
+				t.Errorf("Test %d: DiffLines() got %q, want %q", i+1, got, d.want)
+			}
+		})
+	}
+}